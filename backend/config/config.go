@@ -23,6 +23,38 @@ type Config struct {
 	Port         int
 	FrontendURL  string
 	BackendURL   string
+
+	// Signing keys are read from SigningKeyDir when set, otherwise stored in the
+	// database encrypted with SigningKeySecret, which also encrypts client secrets.
+	SigningKeyDir          string
+	SigningKeySecret       string
+	SigningKeyRotationDays int
+	// SigningKeyOverlapHours is raised to the longest access token lifetime when shorter
+	SigningKeyOverlapHours int
+
+	// A second, TLS listener on TLSPort asks for client certificates for mutual-TLS client
+	// authentication. Behind a TLS-terminating proxy, set MTLSCertHeader instead: the proxy
+	// forwards the URL-encoded PEM certificate in that header, which is only trusted from
+	// MTLSTrustedProxies. Subject DN authentication needs TLSClientCAFile.
+	TLSPort            int
+	TLSCertFile        string
+	TLSKeyFile         string
+	TLSClientCAFile    string
+	MTLSCertHeader     string
+	MTLSTrustedProxies string
+	MTLSBackendURL     string
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header gives the client's
+	// IP, which the device flow rate limits key on. Without them the peer address is used.
+	TrustedProxies string
+
+	// DevMode relaxes checks that get in the way of running everything on one machine, such as
+	// back-channel logout to local or private addresses over plain http.
+	DevMode bool
+
+	// OAuth21Strict applies the OAuth 2.1 rules to every app that does not override it:
+	// S256 PKCE on every authorization request and redirect_uri repeated at the token endpoint.
+	OAuth21Strict bool
 }
 
 var AppConfig Config
@@ -48,6 +80,31 @@ func LoadConfig() {
 		Port:         getEnvInt("PORT", 8080),
 		FrontendURL:  os.Getenv("FRONTEND_URL"),
 		BackendURL:   os.Getenv("BACKEND_URL"),
+
+		SigningKeyDir:          os.Getenv("SIGNING_KEY_DIR"),
+		SigningKeySecret:       os.Getenv("SIGNING_KEY_SECRET"),
+		SigningKeyRotationDays: getEnvInt("SIGNING_KEY_ROTATION_DAYS", 90),
+		SigningKeyOverlapHours: getEnvInt("SIGNING_KEY_OVERLAP_HOURS", 24*30),
+
+		TLSPort:            getEnvInt("TLS_PORT", 8443),
+		TLSCertFile:        os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:         os.Getenv("TLS_KEY_FILE"),
+		TLSClientCAFile:    os.Getenv("TLS_CLIENT_CA_FILE"),
+		MTLSCertHeader:     os.Getenv("MTLS_CERT_HEADER"),
+		MTLSTrustedProxies: os.Getenv("MTLS_TRUSTED_PROXIES"),
+		MTLSBackendURL:     os.Getenv("MTLS_BACKEND_URL"),
+
+		TrustedProxies: os.Getenv("TRUSTED_PROXIES"),
+
+		DevMode: os.Getenv("DEV_MODE") == "true",
+
+		OAuth21Strict: os.Getenv("OAUTH21_STRICT") == "true",
+	}
+
+	// Signing keys and client secrets are encrypted with it, so it is required and must stay
+	// the same across restarts.
+	if AppConfig.SigningKeySecret == "" {
+		log.Fatal("SIGNING_KEY_SECRET must be set")
 	}
 
 	if AppConfig.BackendURL == "" {
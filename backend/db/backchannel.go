@@ -0,0 +1,136 @@
+package db
+
+import (
+	"database/sql"
+	"mirpass-backend/types"
+	"time"
+)
+
+func UpdateAppBackchannelLogoutURI(appID string, uri string) error {
+	_, err := database.Exec("UPDATE applications SET backchannel_logout_uri = NULLIF(?, '') WHERE id = ?", uri, appID)
+	return err
+}
+
+// GetBackchannelLogoutTargets lists the user's sessions that apps may still rely on: the
+// access token has not expired yet, or an unexpired refresh token is still active.
+// Only apps with a back-channel logout URI are included. The sid matches the ID token's
+// sid claim, the SHA-256 of the session id.
+func GetBackchannelLogoutTargets(username string) ([]types.BackchannelDelivery, error) {
+	rows, err := database.Query(`
+		SELECT os.client_id, SHA2(os.session_id, 256)
+		FROM oauth_sessions os
+		JOIN applications a ON a.id = os.client_id
+		WHERE os.username = ? AND os.status = 'consumed'
+			AND a.backchannel_logout_uri IS NOT NULL AND a.backchannel_logout_uri <> ''
+			AND (os.updated_at >= UTC_TIMESTAMP() - INTERVAL a.access_token_lifetime SECOND
+				OR EXISTS (SELECT 1 FROM refresh_tokens rt WHERE rt.session_id = os.session_id AND rt.status = 'active' AND rt.expires_at > UTC_TIMESTAMP()))`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []types.BackchannelDelivery
+	for rows.Next() {
+		var t types.BackchannelDelivery
+		if err := rows.Scan(&t.ClientID, &t.SID); err != nil {
+			return nil, err
+		}
+		t.Username = username
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+func CreateBackchannelDelivery(clientId string, username string, sid string, reason string) error {
+	_, err := database.Exec(`INSERT INTO backchannel_logout_deliveries (client_id, username, sid, reason) VALUES (?, ?, ?, ?)`, clientId, username, sid, reason)
+	return err
+}
+
+// GetDueBackchannelDeliveries returns pending deliveries whose next attempt is due, with the app's current URI.
+func GetDueBackchannelDeliveries(limit int) ([]types.BackchannelDelivery, error) {
+	rows, err := database.Query(`
+		SELECT d.id, d.client_id, a.backchannel_logout_uri, d.username, d.sid, d.reason, d.attempts
+		FROM backchannel_logout_deliveries d
+		JOIN applications a ON a.id = d.client_id
+		WHERE d.status = 'pending' AND d.next_attempt_at <= UTC_TIMESTAMP()
+		ORDER BY d.next_attempt_at ASC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []types.BackchannelDelivery
+	for rows.Next() {
+		var d types.BackchannelDelivery
+		var uri sql.NullString
+		if err := rows.Scan(&d.ID, &d.ClientID, &uri, &d.Username, &d.SID, &d.Reason, &d.Attempts); err != nil {
+			return nil, err
+		}
+		d.URI = uri.String
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// ClaimBackchannelDelivery leases a due delivery for a few minutes so replicas running
+// the worker at the same time do not send it twice. It reports whether the lease was taken.
+func ClaimBackchannelDelivery(id int64) (bool, error) {
+	res, err := database.Exec(`UPDATE backchannel_logout_deliveries SET next_attempt_at = UTC_TIMESTAMP() + INTERVAL 5 MINUTE WHERE id = ? AND status = 'pending' AND next_attempt_at <= UTC_TIMESTAMP()`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func MarkBackchannelDelivered(id int64) error {
+	_, err := database.Exec(`UPDATE backchannel_logout_deliveries SET status = 'delivered', attempts = attempts + 1, last_error = NULL, delivered_at = UTC_TIMESTAMP() WHERE id = ?`, id)
+	return err
+}
+
+// MarkBackchannelAttemptFailed records a failed attempt. A nil retryAt gives up on the delivery.
+func MarkBackchannelAttemptFailed(id int64, reason string, retryAt *time.Time) error {
+	if len(reason) > 512 {
+		reason = reason[:512]
+	}
+	if retryAt == nil {
+		_, err := database.Exec(`UPDATE backchannel_logout_deliveries SET status = 'failed', attempts = attempts + 1, last_error = ? WHERE id = ?`, reason, id)
+		return err
+	}
+	_, err := database.Exec(`UPDATE backchannel_logout_deliveries SET attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE id = ?`, reason, retryAt.UTC(), id)
+	return err
+}
+
+func ListBackchannelDeliveries(appID string) ([]types.BackchannelDelivery, error) {
+	rows, err := database.Query(`
+		SELECT id, username, sid, reason, status, attempts, last_error, next_attempt_at, created_at, delivered_at
+		FROM backchannel_logout_deliveries
+		WHERE client_id = ?
+		ORDER BY created_at DESC LIMIT 100`, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []types.BackchannelDelivery
+	for rows.Next() {
+		var d types.BackchannelDelivery
+		var lastError, nextAttempt, deliveredAt sql.NullString
+		if err := rows.Scan(&d.ID, &d.Username, &d.SID, &d.Reason, &d.Status, &d.Attempts, &lastError, &nextAttempt, &d.CreatedAt, &deliveredAt); err != nil {
+			return nil, err
+		}
+		d.LastError = lastError.String
+		if d.Status == "pending" {
+			d.NextAttemptAt = nextAttempt.String
+		}
+		d.DeliveredAt = deliveredAt.String
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RevokeUserRefreshTokens revokes every active refresh token the user holds with any app.
+func RevokeUserRefreshTokens(username string) error {
+	_, err := database.Exec(`UPDATE refresh_tokens SET status = 'revoked' WHERE username = ? AND status = 'active'`, username)
+	return err
+}
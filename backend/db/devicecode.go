@@ -0,0 +1,39 @@
+package db
+
+import (
+	"time"
+)
+
+// RecordDeviceCodeAttempt counts an attempt against key within a sliding window. Once the
+// window holds limit attempts the key is locked for the length of the window. It reports
+// whether the key is now locked.
+func RecordDeviceCodeAttempt(key string, limit int, window time.Duration) (bool, error) {
+	seconds := int(window.Seconds())
+	// attempts is assigned first, so both expressions still see the old window_start
+	_, err := database.Exec(`INSERT INTO device_code_attempts (attempt_key, attempts, window_start) VALUES (?, 1, UTC_TIMESTAMP())
+		ON DUPLICATE KEY UPDATE
+			attempts = IF(window_start < UTC_TIMESTAMP() - INTERVAL ? SECOND, 1, attempts + 1),
+			window_start = IF(window_start < UTC_TIMESTAMP() - INTERVAL ? SECOND, UTC_TIMESTAMP(), window_start)`,
+		key, seconds, seconds)
+	if err != nil {
+		return false, err
+	}
+	_, err = database.Exec(`UPDATE device_code_attempts SET locked_until = UTC_TIMESTAMP() + INTERVAL ? SECOND
+		WHERE attempt_key = ? AND attempts >= ? AND (locked_until IS NULL OR locked_until < UTC_TIMESTAMP())`, seconds, key, limit)
+	if err != nil {
+		return false, err
+	}
+	_, err = database.Exec(`DELETE FROM device_code_attempts WHERE window_start < UTC_TIMESTAMP() - INTERVAL 1 DAY
+		AND (locked_until IS NULL OR locked_until < UTC_TIMESTAMP())`)
+	if err != nil {
+		return false, err
+	}
+	return DeviceCodeLocked(key)
+}
+
+// DeviceCodeLocked reports whether key is locked out of user code lookups.
+func DeviceCodeLocked(key string) (bool, error) {
+	var count int
+	err := database.QueryRow(`SELECT COUNT(*) FROM device_code_attempts WHERE attempt_key = ? AND locked_until > UTC_TIMESTAMP()`, key).Scan(&count)
+	return count > 0, err
+}
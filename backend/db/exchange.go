@@ -0,0 +1,44 @@
+package db
+
+import "mirpass-backend/types"
+
+// ListTokenExchangeRules lists the apps allowed to exchange tokens for the audience app.
+func ListTokenExchangeRules(audience string) ([]types.TokenExchangeRule, error) {
+	rows, err := database.Query(`
+		SELECT r.id, r.client_id, a.name, r.audience, r.created_by, r.created_at
+		FROM token_exchange_rules r
+		JOIN applications a ON a.id = r.client_id
+		WHERE r.audience = ?
+		ORDER BY r.created_at DESC`, audience)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []types.TokenExchangeRule{}
+	for rows.Next() {
+		var rule types.TokenExchangeRule
+		if err := rows.Scan(&rule.ID, &rule.ClientID, &rule.ClientName, &rule.Audience, &rule.CreatedBy, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func AddTokenExchangeRule(clientID string, audience string, createdBy string) error {
+	_, err := database.Exec(`INSERT IGNORE INTO token_exchange_rules (client_id, audience, created_by) VALUES (?, ?, ?)`, clientID, audience, createdBy)
+	return err
+}
+
+func RemoveTokenExchangeRule(clientID string, audience string) error {
+	_, err := database.Exec(`DELETE FROM token_exchange_rules WHERE client_id = ? AND audience = ?`, clientID, audience)
+	return err
+}
+
+// CanExchangeToken reports whether clientID may exchange user tokens for the audience app.
+func CanExchangeToken(clientID string, audience string) (bool, error) {
+	var count int
+	err := database.QueryRow(`SELECT COUNT(*) FROM token_exchange_rules WHERE client_id = ? AND audience = ?`, clientID, audience).Scan(&count)
+	return count > 0, err
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"database/sql"
+	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"slices"
+	"strings"
+	"time"
+)
+
+// mergeScopes adds the scopes of extra that scope does not have yet.
+func mergeScopes(scope string, extra string) string {
+	scopes := strings.Fields(scope)
+	for _, s := range strings.Fields(extra) {
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// SaveGrant records that the user approved the app for scope. Scopes approved earlier are
+// kept, so the grant covers everything the user has agreed to.
+func SaveGrant(username string, appID string, scope string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+
+	var granted string
+	err = tx.QueryRow(`SELECT scope FROM grants WHERE username = ? AND app_id = ? FOR UPDATE`, username, appID).Scan(&granted)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	merged := mergeScopes(granted, scope)
+	if _, err := tx.Exec(`INSERT INTO grants (username, app_id, scope) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE scope = ?, updated_at = CURRENT_TIMESTAMP`,
+		username, appID, merged, merged); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// HasGrant reports whether the user already approved the app for every scope in scope.
+func HasGrant(username string, appID string, scope string) (bool, error) {
+	var granted string
+	err := database.QueryRow(`SELECT scope FROM grants WHERE username = ? AND app_id = ?`, username, appID).Scan(&granted)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, s := range strings.Fields(scope) {
+		if !utils.HasScope(granted, s) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ListConnectedApps lists the apps the user has granted access to, with their last login
+// from the user's app summary.
+func ListConnectedApps(username string) ([]types.ConnectedApp, error) {
+	summary, err := GetUserAppsSummary(username)
+	if err != nil {
+		return nil, err
+	}
+	lastLogin := map[string]string{}
+	for _, item := range summary {
+		lastLogin[item.AppID] = item.Timestamp
+	}
+
+	rows, err := database.Query(`
+		SELECT a.id, a.name, a.logo_url, g.scope, g.created_at, g.updated_at
+		FROM grants g
+		JOIN applications a ON a.id = g.app_id
+		WHERE g.username = ?
+		ORDER BY g.updated_at DESC`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apps := []types.ConnectedApp{}
+	for rows.Next() {
+		var app types.ConnectedApp
+		var logo sql.NullString
+		var scope string
+		if err := rows.Scan(&app.AppID, &app.App, &logo, &scope, &app.GrantedAt, &app.UpdatedAt); err != nil {
+			return nil, err
+		}
+		app.LogoUrl = logo.String
+		app.Scopes = strings.Fields(scope)
+		app.LastLogin = lastLogin[app.AppID]
+		apps = append(apps, app)
+	}
+	return apps, rows.Err()
+}
+
+// RevokeGrant forgets the user's consent for the app and revokes every token the app holds
+// for them: refresh tokens, and through their sessions' sid the access and ID tokens issued
+// within tokenLifetime. It reports false when there was no grant.
+func RevokeGrant(username string, appID string, tokenLifetime time.Duration) (bool, error) {
+	res, err := database.Exec(`DELETE FROM grants WHERE username = ? AND app_id = ?`, username, appID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	// Sessions that may still have live tokens: recent logins and those with a refresh token
+	rows, err := database.Query(`SELECT session_id FROM oauth_sessions
+		WHERE username = ? AND client_id = ? AND status = 'consumed'
+		AND (updated_at > ? OR session_id IN (SELECT session_id FROM refresh_tokens WHERE status = 'active'))`,
+		username, appID, time.Now().Add(-tokenLifetime))
+	if err != nil {
+		return false, err
+	}
+	var sessions []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return false, err
+		}
+		sessions = append(sessions, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	expiresAt := time.Now().Add(tokenLifetime)
+	for _, id := range sessions {
+		if err := RevokeSessionTokens(id, appID, expiresAt); err != nil {
+			return false, err
+		}
+	}
+	if _, err := database.Exec(`UPDATE refresh_tokens SET status = 'revoked' WHERE username = ? AND client_id = ? AND status = 'active'`, username, appID); err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// seedGrants creates grants from the logins completed before grants were recorded, so
+// users who already approved an app are not asked again. It runs once, with the table.
+func seedGrants(db *sql.DB) error {
+	rows, err := db.Query(`SELECT username, client_id, scope FROM oauth_sessions
+		WHERE status = 'consumed' AND flow_type IN ('authorization_code', 'device_code') AND username IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	type key struct{ username, appID string }
+	granted := map[key]string{}
+	for rows.Next() {
+		var k key
+		var scope sql.NullString
+		if err := rows.Scan(&k.username, &k.appID, &scope); err != nil {
+			rows.Close()
+			return err
+		}
+		granted[k] = mergeScopes(granted[k], scope.String)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// IGNORE skips logins of users or apps that have since been deleted
+	for k, scope := range granted {
+		if _, err := db.Exec(`INSERT IGNORE INTO grants (username, app_id, scope) VALUES (?, ?, ?)`, k.username, k.appID, scope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
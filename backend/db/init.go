@@ -14,6 +14,9 @@ var cfg mysql.Config
 
 var database *sql.DB
 
+// seedGrantsPending is set when InitDB creates the grants table.
+var seedGrantsPending bool
+
 func loadConfig() {
 	cfg = mysql.Config{
 		User:                 config.AppConfig.DBUser,
@@ -39,6 +42,8 @@ func InitDB() error {
 	}
 	defer adminConn.Close()
 
+	var existingGrants int
+
 	// Create the database if it doesn't exist
 	if _, err = adminConn.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s` CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci", cfg.DBName)); err != nil {
 		return fmt.Errorf("create database: %w", err)
@@ -85,6 +90,26 @@ func InitDB() error {
 		   logo_url VARCHAR(511) DEFAULT NULL,
 		   suspend_until TIMESTAMP NULL,
 		   device_code_enabled BOOLEAN DEFAULT FALSE,
+		   access_token_lifetime INT NOT NULL DEFAULT 604800,
+		   id_token_lifetime INT NOT NULL DEFAULT 3600,
+		   refresh_token_lifetime INT NOT NULL DEFAULT 2592000,
+		   allowed_grant_types VARCHAR(512) NOT NULL DEFAULT '` + defaultGrantTypes + `',
+		   require_pkce BOOLEAN NOT NULL DEFAULT FALSE,
+		   allow_plain_pkce BOOLEAN NOT NULL DEFAULT TRUE,
+		   device_code_lifetime INT NOT NULL DEFAULT 900,
+		   device_poll_interval INT NOT NULL DEFAULT 5,
+		   user_code_length INT NOT NULL DEFAULT 8,
+		   user_code_alphabet VARCHAR(16) NOT NULL DEFAULT 'alphanumeric',
+		   require_par BOOLEAN NOT NULL DEFAULT FALSE,
+		   require_signed_request BOOLEAN NOT NULL DEFAULT FALSE,
+		   oauth21_strict BOOLEAN NULL DEFAULT NULL,
+		   first_party BOOLEAN NOT NULL DEFAULT FALSE,
+		   backchannel_logout_uri VARCHAR(512) DEFAULT NULL,
+		   registration_token_hash VARCHAR(128) DEFAULT NULL,
+		   jwks TEXT DEFAULT NULL,
+		   token_endpoint_auth_method VARCHAR(32) DEFAULT NULL,
+		   tls_client_cert_thumbprint VARCHAR(64) DEFAULT NULL,
+		   tls_client_subject_dn VARCHAR(512) DEFAULT NULL,
 	       created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	   )`); err != nil {
 		return fmt.Errorf("create applications table: %w", err)
@@ -115,6 +140,7 @@ func InitDB() error {
 	       app_id VARCHAR(127) NOT NULL,
 	       name VARCHAR(255) DEFAULT NULL,
 	       uri VARCHAR(512) NOT NULL,
+	       kind VARCHAR(16) NOT NULL DEFAULT 'web',
 	       created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 	       FOREIGN KEY (app_id) REFERENCES applications(id) ON DELETE CASCADE
 	   )`); err != nil {
@@ -126,12 +152,15 @@ func InitDB() error {
 			session_id        VARCHAR(128) PRIMARY KEY,
 			client_id         VARCHAR(64)  NOT NULL,
 			username           VARCHAR(64),
-			flow_type         ENUM('authorization_code', 'device_code') NOT NULL,
+			flow_type         ENUM('authorization_code', 'device_code', 'client_credentials') NOT NULL,
 
 			-- Device Code Flow
 			device_code       VARCHAR(128),
 			user_code         VARCHAR(32),
 			last_poll          DATETIME DEFAULT CURRENT_TIMESTAMP,
+			poll_interval     INT NULL,
+			device_ip         VARCHAR(64),
+			device_user_agent VARCHAR(512),
 
 			-- PKCE / Auth Code
 			code_challenge    VARCHAR(256),
@@ -140,6 +169,14 @@ func InitDB() error {
 			auth_code         VARCHAR(128),
 			state			 VARCHAR(255),
 
+			scope             VARCHAR(512),
+			nonce             VARCHAR(255),
+			prompt            VARCHAR(64),
+			max_age           INT NULL,
+			login_hint        VARCHAR(255),
+			resource          TEXT,
+			auth_time         DATETIME NULL,
+
 			status            ENUM(
 								'pending',
 								'authorized',
@@ -154,6 +191,192 @@ func InitDB() error {
 		return fmt.Errorf("create oauth_sessions table: %w", err)
 	}
 
+	// Create refresh tokens table
+	// Tokens issued from the same grant share a family_id so reuse can revoke the whole chain.
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id          INT AUTO_INCREMENT PRIMARY KEY,
+			token_hash  VARCHAR(128) NOT NULL UNIQUE,
+			family_id   VARCHAR(64)  NOT NULL,
+			session_id  VARCHAR(128) NOT NULL,
+			client_id   VARCHAR(64)  NOT NULL,
+			username    VARCHAR(64)  NOT NULL,
+			status      ENUM('active', 'rotated', 'revoked') NOT NULL DEFAULT 'active',
+			replaced_by INT DEFAULT NULL,
+			confidential BOOLEAN DEFAULT FALSE,
+			dpop_jkt    VARCHAR(64)  NULL,
+			expires_at  DATETIME NOT NULL,
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+			used_at     DATETIME NULL,
+			INDEX idx_refresh_family (family_id),
+			FOREIGN KEY (session_id) REFERENCES oauth_sessions(session_id) ON DELETE CASCADE
+		)`); err != nil {
+		return fmt.Errorf("create refresh_tokens table: %w", err)
+	}
+
+	// Create back-channel logout deliveries table
+	// One row per (app, session) to notify; the worker signs a fresh logout token for each attempt.
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS backchannel_logout_deliveries (
+			id              INT AUTO_INCREMENT PRIMARY KEY,
+			client_id       VARCHAR(64)  NOT NULL,
+			username        VARCHAR(64)  NOT NULL,
+			sid             VARCHAR(128) NOT NULL,
+			reason          VARCHAR(32)  NOT NULL,
+			status          ENUM('pending', 'delivered', 'failed') NOT NULL DEFAULT 'pending',
+			attempts        INT NOT NULL DEFAULT 0,
+			last_error      VARCHAR(512) NULL,
+			next_attempt_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			delivered_at    DATETIME NULL,
+			INDEX idx_backchannel_due (status, next_attempt_at),
+			FOREIGN KEY (client_id) REFERENCES applications(id) ON DELETE CASCADE
+		)`); err != nil {
+		return fmt.Errorf("create backchannel_logout_deliveries table: %w", err)
+	}
+
+	// Create logout requests table
+	// Holds a validated RP-initiated logout until the user's browser completes it on the frontend.
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS logout_requests (
+			logout_id    VARCHAR(128) PRIMARY KEY,
+			client_id    VARCHAR(64)  NULL,
+			username     VARCHAR(64)  NULL,
+			redirect_uri VARCHAR(512) NULL,
+			state        VARCHAR(255) NULL,
+			status       ENUM('pending', 'completed') NOT NULL DEFAULT 'pending',
+			expires_at   DATETIME NOT NULL,
+			created_at   DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`); err != nil {
+		return fmt.Errorf("create logout_requests table: %w", err)
+	}
+
+	// Create pushed authorization requests table
+	// params holds the form-encoded authorization request until /oauth2/authorize redeems it once.
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS pushed_auth_requests (
+			request_id  VARCHAR(128) PRIMARY KEY,
+			client_id   VARCHAR(64)  NOT NULL,
+			params      TEXT         NOT NULL,
+			status      ENUM('pending', 'used') NOT NULL DEFAULT 'pending',
+			expires_at  DATETIME NOT NULL,
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`); err != nil {
+		return fmt.Errorf("create pushed_auth_requests table: %w", err)
+	}
+
+	// Create initial access tokens table
+	// Each token lets its holder register clients through /oauth2/register; created_by becomes their root.
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS initial_access_tokens (
+			id           INT AUTO_INCREMENT PRIMARY KEY,
+			token_hash   VARCHAR(128) NOT NULL UNIQUE,
+			name         VARCHAR(128) NULL,
+			created_by   VARCHAR(64)  NOT NULL,
+			max_uses     INT NULL,
+			uses         INT NOT NULL DEFAULT 0,
+			status       ENUM('active', 'revoked') NOT NULL DEFAULT 'active',
+			expires_at   DATETIME NOT NULL,
+			last_used_at DATETIME NULL,
+			created_at   DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_created_by (created_by)
+		)`); err != nil {
+		return fmt.Errorf("create initial_access_tokens table: %w", err)
+	}
+
+	// Create revoked tokens table
+	// Rows only need to outlive the token itself, so they are pruned once expires_at passes.
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS revoked_tokens (
+			jti         VARCHAR(128) PRIMARY KEY,
+			client_id   VARCHAR(64) NOT NULL,
+			expires_at  DATETIME NOT NULL,
+			revoked_at  DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`); err != nil {
+		return fmt.Errorf("create revoked_tokens table: %w", err)
+	}
+
+	// Create API resources table
+	// Resource servers registered by apps; scopes is space-delimited.
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS api_resources (
+			id          VARCHAR(64)  PRIMARY KEY,
+			app_id      VARCHAR(127) NOT NULL,
+			identifier  VARCHAR(255) NOT NULL UNIQUE,
+			name        VARCHAR(255) NOT NULL,
+			scopes      VARCHAR(1024) NOT NULL DEFAULT '',
+			created_at  TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (app_id) REFERENCES applications(id) ON DELETE CASCADE
+		)`); err != nil {
+		return fmt.Errorf("create api_resources table: %w", err)
+	}
+
+	// Create token exchange rules table
+	// Each row lets client_id exchange user tokens for tokens addressed to the audience app.
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS token_exchange_rules (
+			id          INT AUTO_INCREMENT PRIMARY KEY,
+			client_id   VARCHAR(127) NOT NULL,
+			audience    VARCHAR(127) NOT NULL,
+			created_by  VARCHAR(64)  NOT NULL,
+			created_at  TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY uniq_client_audience (client_id, audience),
+			FOREIGN KEY (client_id) REFERENCES applications(id) ON DELETE CASCADE,
+			FOREIGN KEY (audience) REFERENCES applications(id) ON DELETE CASCADE
+		)`); err != nil {
+		return fmt.Errorf("create token_exchange_rules table: %w", err)
+	}
+
+	// Create used JWT ids table
+	// Remembers the jti of one-time JWTs such as client assertions until they expire, to refuse replays.
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS used_jtis (
+			scope       VARCHAR(128) NOT NULL,
+			jti         VARCHAR(255) NOT NULL,
+			expires_at  DATETIME NOT NULL,
+			PRIMARY KEY (scope, jti),
+			INDEX idx_expires_at (expires_at)
+		)`); err != nil {
+		return fmt.Errorf("create used_jtis table: %w", err)
+	}
+
+	// Create grants table
+	// One row per user and app holding every scope the user approved, so consent is asked once.
+	// A new table is seeded from past logins by runMigration, once the session columns exist.
+	err = adminConn.QueryRow(`SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'grants'`).Scan(&existingGrants)
+	if err != nil {
+		return fmt.Errorf("check grants table: %w", err)
+	}
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS grants (
+			username    VARCHAR(255) NOT NULL,
+			app_id      VARCHAR(127) NOT NULL,
+			scope       TEXT NOT NULL,
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (username, app_id),
+			FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE,
+			FOREIGN KEY (app_id) REFERENCES applications(id) ON DELETE CASCADE
+		)`); err != nil {
+		return fmt.Errorf("create grants table: %w", err)
+	}
+	seedGrantsPending = existingGrants == 0
+
+	// Create device code attempts table
+	// Counts user_code lookups per client IP and per code; a key over its limit is locked until locked_until.
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS device_code_attempts (
+			attempt_key  VARCHAR(128) PRIMARY KEY,
+			attempts     INT NOT NULL DEFAULT 0,
+			window_start DATETIME NOT NULL,
+			locked_until DATETIME NULL
+		)`); err != nil {
+		return fmt.Errorf("create device_code_attempts table: %w", err)
+	}
+
+	// Create signing keys table
+	// private_key is AES-GCM encrypted PEM; see SIGNING_KEY_SECRET.
+	if _, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS signing_keys (
+			kid         VARCHAR(64) PRIMARY KEY,
+			algorithm   VARCHAR(16) NOT NULL DEFAULT 'RS256',
+			private_key TEXT NOT NULL,
+			status      ENUM('active', 'inactive', 'retired') NOT NULL,
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+			rotated_at  DATETIME NULL,
+			retired_at  DATETIME NULL
+		)`); err != nil {
+		return fmt.Errorf("create signing_keys table: %w", err)
+	}
+
 	// Create login history table
 	_, err = adminConn.Exec(`CREATE TABLE IF NOT EXISTS history (
 		id INT AUTO_INCREMENT PRIMARY KEY,
@@ -185,6 +408,7 @@ func InitDB() error {
 		app_id VARCHAR(127) NOT NULL,
 		name VARCHAR(255) DEFAULT NULL,
 		secret_hash VARCHAR(255) NOT NULL,
+		secret_encrypted TEXT DEFAULT NULL,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		last_used_at TIMESTAMP NULL,
 		FOREIGN KEY (app_id) REFERENCES applications(id) ON DELETE CASCADE
@@ -0,0 +1,316 @@
+package db
+
+import (
+	"crypto/rsa"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"mirpass-backend/config"
+	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrKeysManagedByFiles = errors.New("signing keys are managed through SIGNING_KEY_DIR")
+
+// InitSigningKeys loads the persistent signing keys, creating the first one if the
+// database has none yet. The server must not start when it fails.
+func InitSigningKeys() error {
+	if config.AppConfig.SigningKeyDir != "" {
+		return loadSigningKeysFromDir()
+	}
+
+	var count int
+	if err := database.QueryRow("SELECT COUNT(*) FROM signing_keys WHERE status = 'active'").Scan(&count); err != nil {
+		return fmt.Errorf("count signing keys: %w", err)
+	}
+	if count == 0 {
+		// Replicas starting together race to create the first key. With the maximum age,
+		// a replica that finds the key another created keeps it, and one that loses the
+		// race on the lock loads it below.
+		if _, err := rotateSigningKey(time.Duration(math.MaxInt64)); err != nil {
+			log.Println("Creating initial signing key failed, loading existing keys:", err)
+		}
+	}
+	return LoadSigningKeys()
+}
+
+// LoadSigningKeys installs the active key and all keys still in their overlap window.
+func LoadSigningKeys() error {
+	if config.AppConfig.SigningKeyDir != "" {
+		return loadSigningKeysFromDir()
+	}
+
+	rows, err := database.Query("SELECT kid, private_key, status FROM signing_keys WHERE status IN ('active', 'inactive') ORDER BY created_at DESC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var activeKid string
+	var active *rsa.PrivateKey
+	var others []utils.PublishedKey
+	for rows.Next() {
+		var kid, encrypted, status string
+		if err := rows.Scan(&kid, &encrypted, &status); err != nil {
+			return err
+		}
+		pemData, err := utils.DecryptSecret(encrypted, config.AppConfig.SigningKeySecret)
+		if err != nil {
+			log.Printf("Skipping signing key %s: cannot decrypt: %v", kid, err)
+			continue
+		}
+		key, err := utils.ParseRSAPrivateKeyPEM(pemData)
+		if err != nil {
+			log.Printf("Skipping signing key %s: %v", kid, err)
+			continue
+		}
+		if status == "active" && active == nil {
+			activeKid, active = kid, key
+			continue
+		}
+		others = append(others, utils.PublishedKey{KeyID: kid, PublicKey: &key.PublicKey})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if active == nil {
+		return fmt.Errorf("no usable active signing key")
+	}
+
+	utils.SetSigningKeys(activeKid, active, others)
+	return nil
+}
+
+// loadSigningKeysFromDir treats every *.pem file as a key named after the file.
+// The most recently modified file signs; the others stay published until removed.
+func loadSigningKeysFromDir() error {
+	files, err := listKeyFiles()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no *.pem files in %s", config.AppConfig.SigningKeyDir)
+	}
+
+	var activeKid string
+	var active *rsa.PrivateKey
+	var others []utils.PublishedKey
+	for _, f := range files {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", f.path, err)
+		}
+		key, err := utils.ParseRSAPrivateKeyPEM(data)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", f.path, err)
+		}
+		if active == nil {
+			activeKid, active = f.kid, key
+			continue
+		}
+		others = append(others, utils.PublishedKey{KeyID: f.kid, PublicKey: &key.PublicKey})
+	}
+
+	utils.SetSigningKeys(activeKid, active, others)
+	return nil
+}
+
+type keyFile struct {
+	kid     string
+	path    string
+	modTime time.Time
+}
+
+func listKeyFiles() ([]keyFile, error) {
+	paths, err := filepath.Glob(filepath.Join(config.AppConfig.SigningKeyDir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []keyFile
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, keyFile{
+			kid:     strings.TrimSuffix(filepath.Base(p), ".pem"),
+			path:    p,
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	return files, nil
+}
+
+func ListSigningKeys() ([]types.SigningKey, error) {
+	if config.AppConfig.SigningKeyDir != "" {
+		files, err := listKeyFiles()
+		if err != nil {
+			return nil, err
+		}
+		var keys []types.SigningKey
+		for i, f := range files {
+			status := "inactive"
+			if i == 0 {
+				status = "active"
+			}
+			keys = append(keys, types.SigningKey{
+				KeyID:     f.kid,
+				Algorithm: "RS256",
+				Status:    status,
+				Source:    "file",
+				CreatedAt: f.modTime.UTC().Format(time.RFC3339),
+			})
+		}
+		return keys, nil
+	}
+
+	rows, err := database.Query("SELECT kid, algorithm, status, created_at, rotated_at, retired_at FROM signing_keys ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []types.SigningKey
+	for rows.Next() {
+		var k types.SigningKey
+		var createdAt, rotatedAt, retiredAt sql.NullString
+		if err := rows.Scan(&k.KeyID, &k.Algorithm, &k.Status, &createdAt, &rotatedAt, &retiredAt); err != nil {
+			return nil, err
+		}
+		k.Source = "database"
+		k.CreatedAt = createdAt.String
+		k.RotatedAt = rotatedAt.String
+		k.RetiredAt = retiredAt.String
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// RotateSigningKey generates a new active key. The previous active key stays
+// published as inactive until the overlap window passes or it is retired manually.
+func RotateSigningKey() (*types.SigningKey, error) {
+	return rotateSigningKey(0)
+}
+
+// rotateSigningKey rotates unless the active key is younger than minAge. The active row
+// is locked so replicas running the scheduled check at the same time rotate only once.
+func rotateSigningKey(minAge time.Duration) (*types.SigningKey, error) {
+	if config.AppConfig.SigningKeyDir != "" {
+		return nil, ErrKeysManagedByFiles
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var currentCreated time.Time
+	err = tx.QueryRow("SELECT created_at FROM signing_keys WHERE status = 'active' ORDER BY created_at DESC LIMIT 1 FOR UPDATE").Scan(&currentCreated)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return nil, err
+	}
+	if err == nil && minAge > 0 && time.Since(currentCreated) < minAge {
+		tx.Rollback()
+		return nil, nil
+	}
+
+	key, err := utils.GenerateRSAKey()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	pemData, err := utils.EncodeRSAPrivateKeyPEM(key)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	encrypted, err := utils.EncryptSecret(pemData, config.AppConfig.SigningKeySecret)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if _, err = tx.Exec("UPDATE signing_keys SET status = 'inactive', rotated_at = UTC_TIMESTAMP() WHERE status = 'active'"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	kid := "mirpass-rs256-" + utils.GenerateID()
+	if _, err = tx.Exec("INSERT INTO signing_keys (kid, algorithm, private_key, status) VALUES (?, 'RS256', ?, 'active')", kid, encrypted); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	log.Printf("Rotated signing key, new kid %s", kid)
+
+	if err := LoadSigningKeys(); err != nil {
+		return nil, err
+	}
+	return &types.SigningKey{
+		KeyID:     kid,
+		Algorithm: "RS256",
+		Status:    "active",
+		Source:    "database",
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// RetireSigningKey stops publishing an inactive key. The active key cannot be retired.
+func RetireSigningKey(kid string) error {
+	if config.AppConfig.SigningKeyDir != "" {
+		return ErrKeysManagedByFiles
+	}
+
+	var status string
+	if err := database.QueryRow("SELECT status FROM signing_keys WHERE kid = ?", kid).Scan(&status); err != nil {
+		return err
+	}
+	if status == "active" {
+		return fmt.Errorf("cannot retire the active signing key, rotate first")
+	}
+
+	if _, err := database.Exec("UPDATE signing_keys SET status = 'retired', retired_at = UTC_TIMESTAMP() WHERE kid = ? AND status = 'inactive'", kid); err != nil {
+		return err
+	}
+	return LoadSigningKeys()
+}
+
+// RunSigningKeyMaintenance periodically applies scheduled rotation, retires keys whose
+// overlap window has passed and reloads the key set so replicas pick up each other's changes.
+func RunSigningKeyMaintenance() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if config.AppConfig.SigningKeyDir == "" {
+			if days := config.AppConfig.SigningKeyRotationDays; days > 0 {
+				if _, err := rotateSigningKey(time.Duration(days) * 24 * time.Hour); err != nil {
+					log.Println("Scheduled signing key rotation failed:", err)
+				}
+			}
+
+			// Tokens signed just before a rotation must stay verifiable until they expire
+			overlap := max(config.AppConfig.SigningKeyOverlapHours, int(utils.MaxAccessTokenLifetime.Hours()))
+			if _, err := database.Exec("UPDATE signing_keys SET status = 'retired', retired_at = UTC_TIMESTAMP() WHERE status = 'inactive' AND rotated_at < UTC_TIMESTAMP() - INTERVAL ? HOUR", overlap); err != nil {
+				log.Println("Retiring expired signing keys failed:", err)
+			}
+		}
+
+		if err := LoadSigningKeys(); err != nil {
+			log.Println("Reloading signing keys failed:", err)
+		}
+	}
+}
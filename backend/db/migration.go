@@ -3,10 +3,177 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"log"
 	"mirpass-backend/utils"
+	"strings"
 )
 
+// columnMigrations adds columns introduced after a table was first created.
+// Fresh installs already get them from InitDB, so each entry is skipped when present.
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"oauth_sessions", "scope", "VARCHAR(512) NULL AFTER state"},
+	{"oauth_sessions", "nonce", "VARCHAR(255) NULL AFTER scope"},
+	{"oauth_sessions", "auth_time", "DATETIME NULL AFTER nonce"},
+	{"oauth_sessions", "prompt", "VARCHAR(64) NULL AFTER nonce"},
+	{"oauth_sessions", "max_age", "INT NULL AFTER prompt"},
+	{"oauth_sessions", "login_hint", "VARCHAR(255) NULL AFTER max_age"},
+	{"oauth_sessions", "resource", "TEXT NULL AFTER login_hint"},
+	{"oauth_sessions", "poll_interval", "INT NULL AFTER last_poll"},
+	{"oauth_sessions", "device_ip", "VARCHAR(64) NULL AFTER poll_interval"},
+	{"oauth_sessions", "device_user_agent", "VARCHAR(512) NULL AFTER device_ip"},
+	{"applications", "access_token_lifetime", "INT NOT NULL DEFAULT 604800 AFTER device_code_enabled"},
+	{"applications", "id_token_lifetime", "INT NOT NULL DEFAULT 3600 AFTER access_token_lifetime"},
+	{"applications", "refresh_token_lifetime", "INT NOT NULL DEFAULT 2592000 AFTER id_token_lifetime"},
+	{"applications", "allowed_grant_types", "VARCHAR(512) NOT NULL DEFAULT '" + defaultGrantTypes + "' AFTER refresh_token_lifetime"},
+	{"applications", "require_pkce", "BOOLEAN NOT NULL DEFAULT FALSE AFTER allowed_grant_types"},
+	{"applications", "allow_plain_pkce", "BOOLEAN NOT NULL DEFAULT TRUE AFTER require_pkce"},
+	{"applications", "device_code_lifetime", "INT NOT NULL DEFAULT 900 AFTER allow_plain_pkce"},
+	{"applications", "device_poll_interval", "INT NOT NULL DEFAULT 5 AFTER device_code_lifetime"},
+	{"applications", "user_code_length", "INT NOT NULL DEFAULT 8 AFTER device_poll_interval"},
+	{"applications", "user_code_alphabet", "VARCHAR(16) NOT NULL DEFAULT 'alphanumeric' AFTER user_code_length"},
+	{"applications", "backchannel_logout_uri", "VARCHAR(512) DEFAULT NULL AFTER device_poll_interval"},
+	{"applications", "registration_token_hash", "VARCHAR(128) DEFAULT NULL AFTER backchannel_logout_uri"},
+	{"applications", "require_par", "BOOLEAN NOT NULL DEFAULT FALSE AFTER device_poll_interval"},
+	{"applications", "require_signed_request", "BOOLEAN NOT NULL DEFAULT FALSE AFTER require_par"},
+	{"applications", "jwks", "TEXT DEFAULT NULL AFTER registration_token_hash"},
+	{"applications", "token_endpoint_auth_method", "VARCHAR(32) DEFAULT NULL AFTER jwks"},
+	{"applications", "tls_client_cert_thumbprint", "VARCHAR(64) DEFAULT NULL AFTER token_endpoint_auth_method"},
+	{"applications", "tls_client_subject_dn", "VARCHAR(512) DEFAULT NULL AFTER tls_client_cert_thumbprint"},
+	{"applications", "oauth21_strict", "BOOLEAN NULL DEFAULT NULL AFTER require_signed_request"},
+	{"applications", "first_party", "BOOLEAN NOT NULL DEFAULT FALSE AFTER oauth21_strict"},
+	{"app_secrets", "secret_encrypted", "TEXT DEFAULT NULL AFTER secret_hash"},
+	{"refresh_tokens", "dpop_jkt", "VARCHAR(64) NULL AFTER confidential"},
+	{"trusted_uris", "kind", "VARCHAR(16) NOT NULL DEFAULT 'web' AFTER uri"},
+}
+
+// columnModifications widen existing column definitions. MODIFY is idempotent, so
+// these simply run on every start.
+var columnModifications = []string{
+	"ALTER TABLE oauth_sessions MODIFY flow_type ENUM('authorization_code', 'device_code', 'client_credentials') NOT NULL",
+}
+
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, table, column).Scan(&count)
+	return count > 0, err
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	exists, err := columnExists(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", table, column, definition))
+	return err
+}
+
+// classifyTrustedURIs runs once, when trusted URIs gain a kind, over the URIs saved before.
+// Loopback and custom-scheme entries get their kind. Entries that no longer validate, such
+// as * wildcards, are flagged invalid so app admins can see and replace them. Matching used
+// to ignore a trailing slash, so each entry also gets its variant with or without one.
+func classifyTrustedURIs(db *sql.DB) error {
+	type trustedURI struct {
+		id    int64
+		appID string
+		name  string
+		uri   string
+	}
+	rows, err := db.Query("SELECT id, app_id, COALESCE(name, ''), uri FROM trusted_uris")
+	if err != nil {
+		return err
+	}
+	var uris []trustedURI
+	existing := map[string]bool{}
+	for rows.Next() {
+		var u trustedURI
+		if err := rows.Scan(&u.id, &u.appID, &u.name, &u.uri); err != nil {
+			rows.Close()
+			return err
+		}
+		uris = append(uris, u)
+		existing[u.appID+" "+u.uri] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range uris {
+		kind, err := utils.ClassifyRedirectURI(u.uri)
+		if err != nil {
+			log.Printf("Trusted URI %q of app %s no longer matches any redirect and is flagged invalid: %v", u.uri, u.appID, err)
+			kind = utils.RedirectURIInvalid
+		}
+		if kind != utils.RedirectURIWeb {
+			if _, err := db.Exec("UPDATE trusted_uris SET kind = ? WHERE id = ?", kind, u.id); err != nil {
+				return err
+			}
+		}
+		if kind == utils.RedirectURIInvalid {
+			continue
+		}
+
+		variant := trailingSlashVariant(u.uri)
+		if variant == "" || existing[u.appID+" "+variant] {
+			continue
+		}
+		variantKind, err := utils.ClassifyRedirectURI(variant)
+		if err != nil {
+			continue
+		}
+		if _, err := db.Exec("INSERT INTO trusted_uris (app_id, name, uri, kind) VALUES (?, ?, ?, ?)", u.appID, u.name, variant, variantKind); err != nil {
+			return err
+		}
+		existing[u.appID+" "+variant] = true
+		log.Printf("Added trusted URI %q to app %s, which %q used to match", variant, u.appID, u.uri)
+	}
+	return nil
+}
+
+// trailingSlashVariant is uri without its trailing slash, or with one when it has none.
+// URIs with a query have no variant.
+func trailingSlashVariant(uri string) string {
+	if strings.Contains(uri, "?") {
+		return ""
+	}
+	if strings.HasSuffix(uri, "/") {
+		return strings.TrimSuffix(uri, "/")
+	}
+	return uri + "/"
+}
+
 func runMigration(db *sql.DB) error {
+	// URIs saved before trusted URIs had a kind are classified once the column is added
+	hasKinds, err := columnExists(db, "trusted_uris", "kind")
+	if err != nil {
+		return fmt.Errorf("checking trusted URI kinds: %w", err)
+	}
+	for _, m := range columnMigrations {
+		if err := addColumnIfMissing(db, m.table, m.column, m.definition); err != nil {
+			return fmt.Errorf("adding column %s.%s: %w", m.table, m.column, err)
+		}
+	}
+	for _, stmt := range columnModifications {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("modifying column: %w", err)
+		}
+	}
+	if !hasKinds {
+		if err := classifyTrustedURIs(db); err != nil {
+			return fmt.Errorf("classifying trusted URIs: %w", err)
+		}
+	}
+	if seedGrantsPending {
+		if err := seedGrants(db); err != nil {
+			return fmt.Errorf("seeding grants: %w", err)
+		}
+		seedGrantsPending = false
+	}
+
 	// Ensure root user exists.
 	// We use ON DUPLICATE KEY UPDATE to ensure the root password is reset to default ('root')
 	// if the hashing algorithm changes or if it was manually messed up.
@@ -2,27 +2,41 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"net/url"
 	"strings"
 	"time"
 )
 
-func CreateDeviceFlowSession(clientId string, sessionId string, deviceCode string, userCode string) error {
-	_, err := database.Exec(`INSERT INTO oauth_sessions (client_id, session_id, device_code, user_code, flow_type, status)
-	VALUES (?, ?, ?, ?, 'device_code', 'pending')`, clientId, sessionId, deviceCode, userCode)
+// CreateDeviceFlowSession starts a device authorization. The device's IP and user agent are
+// kept so the user can recognise the device on the consent screen.
+func CreateDeviceFlowSession(clientId string, sessionId string, deviceCode string, userCode string, scope string, deviceIP string, userAgent string, expiresAt time.Time) error {
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	_, err := database.Exec(`INSERT INTO oauth_sessions (client_id, session_id, device_code, user_code, scope, device_ip, device_user_agent, flow_type, status, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, 'device_code', 'pending', ?)`, clientId, sessionId, deviceCode, userCode, scope, deviceIP, userAgent, expiresAt.UTC())
 	return err
 }
 
 func GetSessionByDeviceCode(deviceCode string) (*types.DeviceFlowSession, error) {
-	row := database.QueryRow(`SELECT client_id, session_id, username, device_code, user_code, status, expires_at, last_poll FROM oauth_sessions WHERE device_code = ?`, deviceCode)
+	row := database.QueryRow(`SELECT client_id, session_id, username, device_code, user_code, scope, auth_time, status, expires_at, last_poll, poll_interval FROM oauth_sessions WHERE device_code = ?`, deviceCode)
 
 	var s types.DeviceFlowSession
 	var username sql.NullString
-	err := row.Scan(&s.ClientID, &s.SessionID, &username, &s.DeviceCode, &s.UserCode, &s.Status, &s.ExpiresAt, &s.LastPoll)
+	var scope sql.NullString
+	var authTime sql.NullString
+	var pollInterval sql.NullInt64
+	err := row.Scan(&s.ClientID, &s.SessionID, &username, &s.DeviceCode, &s.UserCode, &scope, &authTime, &s.Status, &s.ExpiresAt, &s.LastPoll, &pollInterval)
 	if err != nil {
 		return nil, err
 	}
+	s.Scope = scope.String
+	s.AuthTime = authTime.String
+	s.PollInterval = int(pollInterval.Int64)
 	if username.Valid {
 		s.Username = username.String
 	}
@@ -35,17 +49,27 @@ func GetSessionByDeviceCode(deviceCode string) (*types.DeviceFlowSession, error)
 }
 
 func GetAuthCodeSessionBySessionId(sessionId string) (*types.AuthCodeFlowSession, error) {
-	row := database.QueryRow(`SELECT client_id, session_id, redirect_uri, code_challenge, code_challenge_method, state, status, expires_at FROM oauth_sessions WHERE session_id = ?`, sessionId)
+	row := database.QueryRow(`SELECT client_id, session_id, redirect_uri, code_challenge, code_challenge_method, state, scope, prompt, max_age, login_hint, status, expires_at, created_at FROM oauth_sessions WHERE session_id = ?`, sessionId)
 
 	var s types.AuthCodeFlowSession
 	var state sql.NullString
-	err := row.Scan(&s.ClientID, &s.SessionID, &s.RedirectURI, &s.CodeChallenge, &s.CodeChallengeMethod, &state, &s.Status, &s.ExpiresAt)
+	var scope sql.NullString
+	var prompt, loginHint sql.NullString
+	var maxAge sql.NullInt64
+	err := row.Scan(&s.ClientID, &s.SessionID, &s.RedirectURI, &s.CodeChallenge, &s.CodeChallengeMethod, &state, &scope, &prompt, &maxAge, &loginHint, &s.Status, &s.ExpiresAt, &s.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
+	s.Scope = scope.String
 	if state.Valid {
 		s.State = state.String
 	}
+	s.Prompt = prompt.String
+	s.LoginHint = loginHint.String
+	if maxAge.Valid {
+		v := int(maxAge.Int64)
+		s.MaxAge = &v
+	}
 	t, err := time.Parse(time.RFC3339, s.ExpiresAt)
 	if err != nil || time.Now().After(t) {
 		UpdateSessionStatus(s.SessionID, "", "")
@@ -55,15 +79,19 @@ func GetAuthCodeSessionBySessionId(sessionId string) (*types.AuthCodeFlowSession
 }
 
 func GetActiveSessionByUserCode(userCode string) (*types.DeviceFlowSession, error) {
-	userCode = strings.ToUpper(userCode)
-	row := database.QueryRow(`SELECT session_id, client_id, username, device_code, user_code, status, expires_at, last_poll FROM oauth_sessions WHERE user_code = ? AND status = 'pending'`, userCode)
+	row := database.QueryRow(`SELECT session_id, client_id, username, device_code, user_code, scope, status, expires_at, last_poll, device_ip, device_user_agent FROM oauth_sessions WHERE user_code = ? AND status = 'pending' AND flow_type = 'device_code'`, utils.NormalizeUserCode(userCode))
 
 	var s types.DeviceFlowSession
 	var Username sql.NullString
-	err := row.Scan(&s.SessionID, &s.ClientID, &Username, &s.DeviceCode, &s.UserCode, &s.Status, &s.ExpiresAt, &s.LastPoll)
+	var Scope sql.NullString
+	var DeviceIP, DeviceUserAgent sql.NullString
+	err := row.Scan(&s.SessionID, &s.ClientID, &Username, &s.DeviceCode, &s.UserCode, &Scope, &s.Status, &s.ExpiresAt, &s.LastPoll, &DeviceIP, &DeviceUserAgent)
 	if err != nil {
 		return nil, err
 	}
+	s.Scope = Scope.String
+	s.DeviceIP = DeviceIP.String
+	s.DeviceUserAgent = DeviceUserAgent.String
 	if Username.Valid {
 		s.Username = Username.String
 	}
@@ -76,14 +104,30 @@ func GetActiveSessionByUserCode(userCode string) (*types.DeviceFlowSession, erro
 }
 
 func GetSessionBySessionId(sessionId string) (*types.OAuthSession, error) {
-	row := database.QueryRow(`SELECT session_id, client_id, username, flow_type, status, expires_at FROM oauth_sessions WHERE session_id = ?`, sessionId)
+	row := database.QueryRow(`SELECT session_id, client_id, username, flow_type, scope, prompt, max_age, login_hint, resource, auth_time, device_ip, device_user_agent, status, expires_at, created_at FROM oauth_sessions WHERE session_id = ?`, sessionId)
 
 	var s types.OAuthSession
 	var Username sql.NullString
-	err := row.Scan(&s.SessionID, &s.ClientID, &Username, &s.FlowType, &s.Status, &s.ExpiresAt)
+	var Scope sql.NullString
+	var Prompt, LoginHint, Resource sql.NullString
+	var MaxAge sql.NullInt64
+	var AuthTime sql.NullString
+	var DeviceIP, DeviceUserAgent sql.NullString
+	err := row.Scan(&s.SessionID, &s.ClientID, &Username, &s.FlowType, &Scope, &Prompt, &MaxAge, &LoginHint, &Resource, &AuthTime, &DeviceIP, &DeviceUserAgent, &s.Status, &s.ExpiresAt, &s.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
+	s.DeviceIP = DeviceIP.String
+	s.DeviceUserAgent = DeviceUserAgent.String
+	s.Scope = Scope.String
+	s.Prompt = Prompt.String
+	s.LoginHint = LoginHint.String
+	s.Resources = strings.Fields(Resource.String)
+	if MaxAge.Valid {
+		v := int(MaxAge.Int64)
+		s.MaxAge = &v
+	}
+	s.AuthTime = AuthTime.String
 	if Username.Valid {
 		s.Username = Username.String
 	}
@@ -95,6 +139,19 @@ func UpdateSessionPoll(sessionId string) error {
 	return err
 }
 
+// SlowDownSession raises the minimum poll interval of a device session after a slow_down.
+func SlowDownSession(sessionId string, interval int) error {
+	_, err := database.Exec(`UPDATE oauth_sessions SET poll_interval = ? WHERE session_id = ?`, interval, sessionId)
+	return err
+}
+
+// UserCodeInUse reports whether a pending device session already has the user code.
+func UserCodeInUse(userCode string) (bool, error) {
+	var count int
+	err := database.QueryRow(`SELECT COUNT(*) FROM oauth_sessions WHERE user_code = ? AND status = 'pending' AND flow_type = 'device_code'`, userCode).Scan(&count)
+	return count > 0, err
+}
+
 func UpdateSessionStatus(sessionId string, status string, username string) error {
 	session, err := GetSessionBySessionId(sessionId)
 	if err != nil {
@@ -131,8 +188,15 @@ func UpdateSessionStatus(sessionId string, status string, username string) error
 	return err
 }
 
-func CreateAuthCodeSession(clientId string, sessionId string, redirect_uri string, code_challenge string, code_challenge_method string, state string) error {
-	_, err := database.Exec(`INSERT INTO oauth_sessions (client_id, session_id, redirect_uri, code_challenge, code_challenge_method, state, flow_type, status) VALUES (?, ?, ?, ?, ?, ?, 'authorization_code', 'pending')`, clientId, sessionId, redirect_uri, code_challenge, code_challenge_method, state)
+func CreateAuthCodeSession(sessionId string, req *types.AuthCodeFlowRequest) error {
+	_, err := database.Exec(`INSERT INTO oauth_sessions (client_id, session_id, redirect_uri, code_challenge, code_challenge_method, state, scope, nonce, prompt, max_age, login_hint, resource, flow_type, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, NULLIF(?, ''), NULLIF(?, ''), 'authorization_code', 'pending')`,
+		req.ClientID, sessionId, req.RedirectURI, req.CodeChallenge, req.CodeChallengeMethod, req.State, req.Scope, req.Nonce, req.Prompt, req.MaxAge, req.LoginHint, strings.Join(req.Resources, " "))
+	return err
+}
+
+// SetSessionAuthTime records when the consenting user last authenticated, for the auth_time claim.
+func SetSessionAuthTime(sessionId string, authTime time.Time) error {
+	_, err := database.Exec(`UPDATE oauth_sessions SET auth_time = ? WHERE session_id = ?`, authTime.UTC(), sessionId)
 	return err
 }
 
@@ -142,16 +206,24 @@ func UpdateAuthCodeSessionCode(sessionId string, code string, username string) e
 }
 
 func GetAuthCodeSessionByCode(code string) (*types.AuthCodeFlowSession, error) {
-	row := database.QueryRow(`SELECT client_id, session_id, redirect_uri, code_challenge, code_challenge_method, state, status, expires_at, username FROM oauth_sessions WHERE auth_code = ?`, code)
+	row := database.QueryRow(`SELECT client_id, session_id, redirect_uri, code_challenge, code_challenge_method, state, scope, nonce, resource, auth_time, status, expires_at, username FROM oauth_sessions WHERE auth_code = ?`, code)
 
 	var s types.AuthCodeFlowSession
 	var State sql.NullString
+	var Scope sql.NullString
+	var Nonce sql.NullString
+	var Resource sql.NullString
+	var AuthTime sql.NullString
 	var Username sql.NullString
-	err := row.Scan(&s.ClientID, &s.SessionID, &s.RedirectURI, &s.CodeChallenge, &s.CodeChallengeMethod, &State, &s.Status, &s.ExpiresAt, &Username)
+	err := row.Scan(&s.ClientID, &s.SessionID, &s.RedirectURI, &s.CodeChallenge, &s.CodeChallengeMethod, &State, &Scope, &Nonce, &Resource, &AuthTime, &s.Status, &s.ExpiresAt, &Username)
 	if err != nil {
 		return nil, err
 	}
 	s.State = State.String
+	s.Scope = Scope.String
+	s.Resources = strings.Fields(Resource.String)
+	s.Nonce = Nonce.String
+	s.AuthTime = AuthTime.String
 	if Username.Valid {
 		s.Username = Username.String
 	}
@@ -163,7 +235,199 @@ func GetAuthCodeSessionByCode(code string) (*types.AuthCodeFlowSession, error) {
 	return &s, nil
 }
 
+// RecordClientCredentialsGrant logs a client_credentials issuance as a consumed session
+// without a user, so it is counted in the app's stats and history.
+func RecordClientCredentialsGrant(clientId string, sessionId string) error {
+	_, err := database.Exec(`INSERT INTO oauth_sessions (client_id, session_id, flow_type, status) VALUES (?, ?, 'client_credentials', 'consumed')`, clientId, sessionId)
+	return err
+}
+
+func CreatePushedAuthRequest(requestId string, clientId string, params string, expiresAt time.Time) error {
+	_, err := database.Exec(`INSERT INTO pushed_auth_requests (request_id, client_id, params, expires_at) VALUES (?, ?, ?, ?)`,
+		requestId, clientId, params, expiresAt.UTC())
+	return err
+}
+
+// ConsumePushedAuthRequest redeems a pushed request once. The client_id sent alongside the
+// request_uri must match the client that pushed it.
+func ConsumePushedAuthRequest(requestId string, clientId string) (url.Values, error) {
+	res, err := database.Exec(`UPDATE pushed_auth_requests SET status = 'used' WHERE request_id = ? AND client_id = ? AND status = 'pending' AND expires_at > UTC_TIMESTAMP()`, requestId, clientId)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return nil, fmt.Errorf("pushed request not found or expired")
+	}
+
+	var params string
+	if err := database.QueryRow(`SELECT params FROM pushed_auth_requests WHERE request_id = ?`, requestId).Scan(&params); err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(params)
+}
+
 func AddHistory(username string, appId string) error {
 	_, err := database.Exec(`INSERT INTO history (username, app_id) VALUES (?, ?)`, username, appId)
 	return err
 }
+
+var ErrRefreshTokenReused = errors.New("refresh token already used")
+
+func CreateRefreshToken(familyId string, sessionId string, clientId string, username string, tokenHash string, confidential bool, dpopJKT string, expiresAt time.Time) error {
+	_, err := database.Exec(`INSERT INTO refresh_tokens (family_id, session_id, client_id, username, token_hash, confidential, dpop_jkt, expires_at) VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)`,
+		familyId, sessionId, clientId, username, tokenHash, confidential, dpopJKT, expiresAt.UTC())
+	return err
+}
+
+func GetRefreshToken(tokenHash string) (*types.RefreshToken, error) {
+	row := database.QueryRow(`SELECT id, token_hash, family_id, session_id, client_id, username, status, confidential, dpop_jkt, expires_at FROM refresh_tokens WHERE token_hash = ?`, tokenHash)
+
+	var t types.RefreshToken
+	var dpopJKT sql.NullString
+	err := row.Scan(&t.ID, &t.TokenHash, &t.FamilyID, &t.SessionID, &t.ClientID, &t.Username, &t.Status, &t.Confidential, &dpopJKT, &t.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	t.DPoPJKT = dpopJKT.String
+	return &t, nil
+}
+
+// RotateRefreshToken marks the old token as used and stores its successor in the same family.
+// It returns ErrRefreshTokenReused if the old token was already rotated by a concurrent request.
+func RotateRefreshToken(old *types.RefreshToken, newHash string, expiresAt time.Time) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`UPDATE refresh_tokens SET status = 'rotated', used_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'active'`, old.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if affected == 0 {
+		tx.Rollback()
+		return ErrRefreshTokenReused
+	}
+
+	insert, err := tx.Exec(`INSERT INTO refresh_tokens (family_id, session_id, client_id, username, token_hash, confidential, dpop_jkt, expires_at) VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)`,
+		old.FamilyID, old.SessionID, old.ClientID, old.Username, newHash, old.Confidential, old.DPoPJKT, expiresAt.UTC())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	newId, _ := insert.LastInsertId()
+
+	if _, err = tx.Exec(`UPDATE refresh_tokens SET replaced_by = ? WHERE id = ?`, newId, old.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func RevokeRefreshTokenFamily(familyId string) error {
+	_, err := database.Exec(`UPDATE refresh_tokens SET status = 'revoked' WHERE family_id = ? AND status <> 'revoked'`, familyId)
+	return err
+}
+
+// ConsumeAuthorizedSession marks an authorized code or device session as used. It reports
+// false when another request consumed it first, so each grant yields tokens at most once.
+func ConsumeAuthorizedSession(sessionId string) (bool, error) {
+	res, err := database.Exec(`UPDATE oauth_sessions SET status = 'consumed' WHERE session_id = ? AND status = 'authorized'`, sessionId)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// RevokeSessionTokens revokes the refresh tokens of a session and, through its sid, every
+// access and ID token issued from it until expiresAt.
+func RevokeSessionTokens(sessionId string, clientId string, expiresAt time.Time) error {
+	if _, err := database.Exec(`UPDATE refresh_tokens SET status = 'revoked' WHERE session_id = ? AND status <> 'revoked'`, sessionId); err != nil {
+		return err
+	}
+	return RevokeToken(utils.RevokedSessionKey(utils.SessionSID(sessionId)), clientId, expiresAt)
+}
+
+func RevokeToken(jti string, clientId string, expiresAt time.Time) error {
+	_, err := database.Exec(`INSERT IGNORE INTO revoked_tokens (jti, client_id, expires_at) VALUES (?, ?, ?)`, jti, clientId, expiresAt.UTC())
+	if err != nil {
+		return err
+	}
+	_, err = database.Exec(`DELETE FROM revoked_tokens WHERE expires_at < UTC_TIMESTAMP()`)
+	return err
+}
+
+// MarkJTIUsed records a one-time JWT id within scope until expiresAt. It reports false
+// when the id was already used, which means the JWT is being replayed.
+func MarkJTIUsed(scope string, jti string, expiresAt time.Time) (bool, error) {
+	res, err := database.Exec(`INSERT IGNORE INTO used_jtis (scope, jti, expires_at) VALUES (?, ?, ?)`, scope, jti, expiresAt.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if _, err := database.Exec(`DELETE FROM used_jtis WHERE expires_at < UTC_TIMESTAMP()`); err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func IsTokenRevoked(jti string) bool {
+	var count int
+	err := database.QueryRow(`SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?`, jti).Scan(&count)
+	if err != nil {
+		// Fail closed: a token we cannot check is treated as revoked
+		return true
+	}
+	return count > 0
+}
+
+func CreateLogoutRequest(req *types.LogoutRequest, expiresAt time.Time) error {
+	_, err := database.Exec(`INSERT INTO logout_requests (logout_id, client_id, username, redirect_uri, state, expires_at) VALUES (?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?)`,
+		req.LogoutID, req.ClientID, req.Username, req.RedirectURI, req.State, expiresAt.UTC())
+	return err
+}
+
+// GetLogoutRequest returns a pending, unexpired logout request.
+func GetLogoutRequest(logoutId string) (*types.LogoutRequest, error) {
+	var req types.LogoutRequest
+	var clientId, username, redirectUri, state sql.NullString
+	err := database.QueryRow(`SELECT logout_id, client_id, username, redirect_uri, state, status, expires_at FROM logout_requests WHERE logout_id = ? AND status = 'pending' AND expires_at > UTC_TIMESTAMP()`, logoutId).
+		Scan(&req.LogoutID, &clientId, &username, &redirectUri, &state, &req.Status, &req.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	req.ClientID = clientId.String
+	req.Username = username.String
+	req.RedirectURI = redirectUri.String
+	req.State = state.String
+	return &req, nil
+}
+
+// CompleteLogoutRequest marks the request used. It reports false if another call got there first.
+func CompleteLogoutRequest(logoutId string) (bool, error) {
+	res, err := database.Exec(`UPDATE logout_requests SET status = 'completed' WHERE logout_id = ? AND status = 'pending'`, logoutId)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	// Old requests are only kept while they can still be completed
+	database.Exec(`DELETE FROM logout_requests WHERE expires_at < UTC_TIMESTAMP() - INTERVAL 1 DAY`)
+	return n == 1, nil
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 
+	"mirpass-backend/config"
 	"mirpass-backend/types"
 	"mirpass-backend/utils"
 
@@ -68,11 +69,11 @@ func GetUserLoginHistory(username string, dateStr string, offsetMinutes int) ([]
 func GetUserAppsSummary(username string) ([]types.AppLoginSummaryItem, error) {
 	// Returns distinct apps and last login time
 	query := `
-		SELECT a.name as app, a.logo_url, MAX(os.updated_at) as last_login
+		SELECT a.id, a.name as app, a.logo_url, MAX(os.updated_at) as last_login
 		FROM oauth_sessions os
 		JOIN applications a ON os.client_id = a.id
 		WHERE os.username = ? AND os.status = 'consumed'
-		GROUP BY a.name, a.logo_url
+		GROUP BY a.id, a.name, a.logo_url
 		ORDER BY last_login DESC
 	`
 	rows, err := database.Query(query, username)
@@ -85,7 +86,7 @@ func GetUserAppsSummary(username string) ([]types.AppLoginSummaryItem, error) {
 	for rows.Next() {
 		var item types.AppLoginSummaryItem
 		var logo sql.NullString
-		if err := rows.Scan(&item.App, &logo, &item.Timestamp); err != nil {
+		if err := rows.Scan(&item.AppID, &item.App, &logo, &item.Timestamp); err != nil {
 			return nil, err
 		}
 		item.LogoUrl = logo.String
@@ -109,7 +110,7 @@ func GetAppLoginStats(appID string) ([]types.LoginHistoryItem, int, error) {
 	// Let's return the raw history list for the last 7 days.
 
 	query := `
-		SELECT username, updated_at
+		SELECT username, flow_type, updated_at
 		FROM oauth_sessions
 		WHERE client_id = ? AND status='consumed' AND updated_at >= DATE_SUB(UTC_TIMESTAMP(), INTERVAL 7 DAY)
 		ORDER BY updated_at DESC
@@ -124,10 +125,14 @@ func GetAppLoginStats(appID string) ([]types.LoginHistoryItem, int, error) {
 	for rows.Next() {
 		var item types.LoginHistoryItem
 		var user sql.NullString
-		if err := rows.Scan(&user, &item.Timestamp); err != nil {
+		var flowType string
+		if err := rows.Scan(&user, &flowType, &item.Timestamp); err != nil {
 			return nil, 0, err
 		}
 		item.User = user.String
+		if flowType == "client_credentials" {
+			item.Grant = flowType
+		}
 		history = append(history, item)
 	}
 
@@ -254,7 +259,8 @@ func CreateVerification(username, token, task, detail string) error {
 	return err
 }
 
-func VerifyUserByToken(token string) (string, error) {
+// VerifyUserByToken applies a verification and returns the affected username and task.
+func VerifyUserByToken(token string) (string, string, error) {
 	var username, task string
 	var detail sql.NullString
 	// Use explicit columns to avoid scan errors if schema drifted
@@ -265,13 +271,13 @@ func VerifyUserByToken(token string) (string, error) {
 		WHERE token = ? AND expires_at > UTC_TIMESTAMP()`, token).Scan(&username, &task, &detail)
 
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	// Begin transaction
 	tx, err := database.Begin()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	deleteToken := true
@@ -307,22 +313,22 @@ func VerifyUserByToken(token string) (string, error) {
 
 	if err != nil {
 		tx.Rollback()
-		return "", err
+		return "", "", err
 	}
 
 	if deleteToken {
 		_, err = tx.Exec("DELETE FROM verifications WHERE token = ?", token)
 		if err != nil {
 			tx.Rollback()
-			return "", err
+			return "", "", err
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	return task, nil
+	return username, task, nil
 }
 
 func UpdateUserNickname(username, nickname string) error {
@@ -645,11 +651,31 @@ func GetApplication(appID string) (*types.Application, error) {
 	// ClientSecret is deprecated in this struct
 
 	// We ignore client_secret column now
-	err := database.QueryRow("SELECT id, name, description, logo_url, suspend_until, device_code_enabled, created_at FROM applications WHERE id = ?", appID).
-		Scan(&app.ID, &app.Name, &app.Description, &logoUrl, &suspendUntil, &deviceCodeEnabled, &createdAt)
+	var grantTypes string
+	var backchannelURI, jwks, authMethod, tlsThumbprint, tlsSubject sql.NullString
+	var strict sql.NullBool
+	p := &app.Policy
+	err := database.QueryRow(`SELECT id, name, description, logo_url, suspend_until, device_code_enabled, first_party,
+		access_token_lifetime, id_token_lifetime, refresh_token_lifetime, allowed_grant_types,
+		require_pkce, allow_plain_pkce, device_code_lifetime, device_poll_interval, user_code_length, user_code_alphabet, require_par, require_signed_request, oauth21_strict, backchannel_logout_uri, jwks, token_endpoint_auth_method,
+		tls_client_cert_thumbprint, tls_client_subject_dn, created_at
+		FROM applications WHERE id = ?`, appID).
+		Scan(&app.ID, &app.Name, &app.Description, &logoUrl, &suspendUntil, &deviceCodeEnabled, &app.FirstParty,
+			&p.AccessTokenLifetime, &p.IDTokenLifetime, &p.RefreshTokenLifetime, &grantTypes,
+			&p.RequirePKCE, &p.AllowPlainPKCE, &p.DeviceCodeLifetime, &p.DevicePollInterval, &p.UserCodeLength, &p.UserCodeAlphabet, &p.RequirePAR, &p.RequireSignedRequest, &strict, &backchannelURI, &jwks, &authMethod,
+			&tlsThumbprint, &tlsSubject, &createdAt)
 	if err != nil {
 		return nil, err
 	}
+	p.AllowedGrantTypes = strings.Fields(grantTypes)
+	if strict.Valid {
+		p.OAuth21Strict = &strict.Bool
+	}
+	app.BackchannelLogoutURI = backchannelURI.String
+	app.JWKS = jwks.String
+	app.TokenEndpointAuthMethod = authMethod.String
+	app.TLSClientCertThumbprint = tlsThumbprint.String
+	app.TLSClientSubjectDN = tlsSubject.String
 	app.CreatedAt = createdAt.String
 	app.LogoURL = logoUrl.String
 	if suspendUntil.Valid {
@@ -667,8 +693,13 @@ func GetApplication(appID string) (*types.Application, error) {
 func CreateAppSecret(appID string, name string) (*types.CreateSecretResponse, error) {
 	secret := utils.GenerateApiKey()
 	hash := utils.Sha256(secret) // Storing hash
+	// client_secret_jwt needs the secret itself as the HMAC key, so keep an encrypted copy
+	encrypted, err := utils.EncryptSecret([]byte(secret), config.AppConfig.SigningKeySecret)
+	if err != nil {
+		return nil, err
+	}
 
-	res, err := database.Exec("INSERT INTO app_secrets (app_id, name, secret_hash) VALUES (?, ?, ?)", appID, name, hash)
+	res, err := database.Exec("INSERT INTO app_secrets (app_id, name, secret_hash, secret_encrypted) VALUES (?, ?, ?, ?)", appID, name, hash, encrypted)
 	if err != nil {
 		return nil, err
 	}
@@ -725,6 +756,30 @@ func ValidateAppSecret(appID string, plainSecret string) bool {
 	return false
 }
 
+// GetAppSecretKeys returns the app's secrets in plain text for verifying client_secret_jwt.
+// Secrets created before encrypted copies were kept cannot be recovered and are skipped.
+func GetAppSecretKeys(appID string) ([]string, error) {
+	rows, err := database.Query("SELECT secret_encrypted FROM app_secrets WHERE app_id = ? AND secret_encrypted IS NOT NULL", appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var secrets []string
+	for rows.Next() {
+		var encrypted string
+		if err := rows.Scan(&encrypted); err != nil {
+			return nil, err
+		}
+		plain, err := utils.DecryptSecret(encrypted, config.AppConfig.SigningKeySecret)
+		if err != nil {
+			continue
+		}
+		secrets = append(secrets, string(plain))
+	}
+	return secrets, rows.Err()
+}
+
 func IsAppAdmin(username, appID string) (bool, error) {
 	var count int
 	err := database.QueryRow("SELECT COUNT(*) FROM admins WHERE username = ? AND (app = ? OR app = 'system') AND (role = 'admin' OR role = 'root')", username, appID).Scan(&count)
@@ -753,7 +808,7 @@ func IsAppRoot(username, appID string) (bool, error) {
 }
 
 func GetTrustedURIs(appID string) ([]types.TrustedURI, error) {
-	rows, err := database.Query("SELECT id, app_id, COALESCE(name, ''), uri, created_at FROM trusted_uris WHERE app_id = ? ORDER BY created_at DESC", appID)
+	rows, err := database.Query("SELECT id, app_id, COALESCE(name, ''), uri, kind, created_at FROM trusted_uris WHERE app_id = ? ORDER BY created_at DESC", appID)
 	if err != nil {
 		return nil, err
 	}
@@ -763,7 +818,7 @@ func GetTrustedURIs(appID string) ([]types.TrustedURI, error) {
 	for rows.Next() {
 		var u types.TrustedURI
 		var createdAt sql.NullString
-		if err := rows.Scan(&u.ID, &u.AppID, &u.Name, &u.URI, &createdAt); err != nil {
+		if err := rows.Scan(&u.ID, &u.AppID, &u.Name, &u.URI, &u.Kind, &createdAt); err != nil {
 			return nil, err
 		}
 		u.CreatedAt = createdAt.String
@@ -772,7 +827,7 @@ func GetTrustedURIs(appID string) ([]types.TrustedURI, error) {
 	return uris, nil
 }
 
-func AddTrustedURI(appID, name, uri string) (int64, error) {
+func AddTrustedURI(appID, name, uri, kind string) (int64, error) {
 	var count int
 	err := database.QueryRow("SELECT COUNT(*) FROM trusted_uris WHERE app_id = ? AND uri = ?", appID, uri).Scan(&count)
 	if err != nil {
@@ -782,7 +837,7 @@ func AddTrustedURI(appID, name, uri string) (int64, error) {
 		return 0, fmt.Errorf("trusted uri already exists")
 	}
 
-	res, err := database.Exec("INSERT INTO trusted_uris (app_id, name, uri) VALUES (?, ?, ?)", appID, name, uri)
+	res, err := database.Exec("INSERT INTO trusted_uris (app_id, name, uri, kind) VALUES (?, ?, ?, ?)", appID, name, uri, kind)
 	if err != nil {
 		return 0, err
 	}
@@ -804,29 +859,25 @@ func DeleteTrustedURI(uriID int64, appID string) error {
 	return nil
 }
 
+// IsTrustedURI reports whether uri matches one of the app's trusted URIs: exactly, or for
+// loopback entries on any port (RFC 8252).
 func IsTrustedURI(appID, uri string) (bool, error) {
-	rows, err := database.Query("SELECT uri FROM trusted_uris WHERE app_id = ?", appID)
+	rows, err := database.Query("SELECT uri, kind FROM trusted_uris WHERE app_id = ?", appID)
 	if err != nil {
 		return false, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var trustedURI string
-		if err := rows.Scan(&trustedURI); err != nil {
+		var trustedURI, kind string
+		if err := rows.Scan(&trustedURI, &kind); err != nil {
 			return false, err
 		}
-		normalizedURI := strings.TrimRight(uri, "/")
-		if strings.HasSuffix(trustedURI, "*") {
-			prefix := strings.TrimSuffix(trustedURI, "*")
-			if strings.HasPrefix(normalizedURI, strings.TrimRight(prefix, "/")) {
-				return true, nil
-			}
-		} else if strings.TrimRight(trustedURI, "/") == normalizedURI {
+		if utils.RedirectURIMatches(kind, trustedURI, uri) {
 			return true, nil
 		}
 	}
-	return false, nil
+	return false, rows.Err()
 }
 
 func UpdateAppInfo(appID, name, description, logoUrl string) error {
@@ -835,6 +886,11 @@ func UpdateAppInfo(appID, name, description, logoUrl string) error {
 	return err
 }
 
+func UpdateAppFirstParty(appID string, firstParty bool) error {
+	_, err := database.Exec("UPDATE applications SET first_party = ? WHERE id = ?", firstParty, appID)
+	return err
+}
+
 func UpdateAppSuspension(appID string, suspendUntil *string) error {
 	query := "UPDATE applications SET suspend_until = ? WHERE id = ?"
 	_, err := database.Exec(query, suspendUntil, appID)
@@ -847,8 +903,32 @@ func UpdateDeviceCodeEnabled(appID string, enabled bool) error {
 	return err
 }
 
+// defaultGrantTypes is the column default for applications.allowed_grant_types.
+const defaultGrantTypes = "authorization_code refresh_token urn:ietf:params:oauth:grant-type:device_code client_credentials"
+
+func UpdateAppPolicy(appID string, p types.AppPolicy) error {
+	query := `UPDATE applications SET access_token_lifetime = ?, id_token_lifetime = ?, refresh_token_lifetime = ?,
+		allowed_grant_types = ?, require_pkce = ?, allow_plain_pkce = ?, device_code_lifetime = ?, device_poll_interval = ?,
+		user_code_length = ?, user_code_alphabet = ?, require_par = ?, require_signed_request = ?, oauth21_strict = ?
+		WHERE id = ?`
+	_, err := database.Exec(query, p.AccessTokenLifetime, p.IDTokenLifetime, p.RefreshTokenLifetime,
+		strings.Join(p.AllowedGrantTypes, " "), p.RequirePKCE, p.AllowPlainPKCE, p.DeviceCodeLifetime, p.DevicePollInterval,
+		p.UserCodeLength, p.UserCodeAlphabet, p.RequirePAR, p.RequireSignedRequest, p.OAuth21Strict, appID)
+	return err
+}
+
+func UpdateAppJWKS(appID string, jwks string) error {
+	_, err := database.Exec("UPDATE applications SET jwks = NULLIF(?, '') WHERE id = ?", jwks, appID)
+	return err
+}
+
+func UpdateAppTLSClientAuth(appID string, thumbprint string, subjectDN string) error {
+	_, err := database.Exec("UPDATE applications SET tls_client_cert_thumbprint = NULLIF(?, ''), tls_client_subject_dn = NULLIF(?, '') WHERE id = ?", thumbprint, subjectDN, appID)
+	return err
+}
+
 func GetAllApps() ([]types.Application, error) {
-	query := "SELECT id, name, description, logo_url, suspend_until, created_at FROM applications ORDER BY name ASC"
+	query := "SELECT id, name, description, logo_url, suspend_until, first_party, created_at FROM applications ORDER BY name ASC"
 	rows, err := database.Query(query)
 	if err != nil {
 		return nil, err
@@ -862,7 +942,7 @@ func GetAllApps() ([]types.Application, error) {
 		var suspendUntil sql.NullString
 		var createdAt sql.NullString
 
-		if err := rows.Scan(&app.ID, &app.Name, &app.Description, &logoUrl, &suspendUntil, &createdAt); err != nil {
+		if err := rows.Scan(&app.ID, &app.Name, &app.Description, &logoUrl, &suspendUntil, &app.FirstParty, &createdAt); err != nil {
 			return nil, err
 		}
 		app.LogoURL = logoUrl.String
@@ -878,7 +958,7 @@ func GetAllApps() ([]types.Application, error) {
 
 func SearchApps(query string) ([]types.Application, error) {
 	q := "%" + query + "%"
-	stmt := "SELECT id, name, description, logo_url, suspend_until, created_at FROM applications WHERE name LIKE ? OR description LIKE ? ORDER BY name ASC"
+	stmt := "SELECT id, name, description, logo_url, suspend_until, first_party, created_at FROM applications WHERE name LIKE ? OR description LIKE ? ORDER BY name ASC"
 	rows, err := database.Query(stmt, q, q)
 	if err != nil {
 		return nil, err
@@ -892,7 +972,7 @@ func SearchApps(query string) ([]types.Application, error) {
 		var suspendUntil sql.NullString
 		var createdAt sql.NullString
 
-		if err := rows.Scan(&app.ID, &app.Name, &app.Description, &logoUrl, &suspendUntil, &createdAt); err != nil {
+		if err := rows.Scan(&app.ID, &app.Name, &app.Description, &logoUrl, &suspendUntil, &app.FirstParty, &createdAt); err != nil {
 			return nil, err
 		}
 		app.LogoURL = logoUrl.String
@@ -988,7 +1068,7 @@ func GetAppStatsSummary(appID string) (*types.AppStatsSummary, error) {
 		SELECT COUNT(*) FROM (
 			SELECT username 
 			FROM oauth_sessions 
-			WHERE client_id = ? AND status = 'consumed' 
+			WHERE client_id = ? AND status = 'consumed' AND username IS NOT NULL
 			GROUP BY username 
 			HAVING MIN(updated_at) >= UTC_TIMESTAMP() - INTERVAL 24 HOUR
 		) as new_u`
@@ -1033,7 +1113,7 @@ func GetAppStatsSummary(appID string) (*types.AppStatsSummary, error) {
 		FROM (
 			SELECT MIN(updated_at) as min_date 
 			FROM oauth_sessions 
-			WHERE client_id = ? AND status = 'consumed'
+			WHERE client_id = ? AND status = 'consumed' AND username IS NOT NULL
 			GROUP BY username
 		) as user_firsts
 		WHERE min_date >= DATE_SUB(UTC_DATE(), INTERVAL 6 DAY)
@@ -1087,7 +1167,7 @@ func GetAppHistory(appID string, dateStr string, offsetMinutes int) ([]types.Log
 		utcEnd := utcStart.Add(24 * time.Hour)
 
 		query = `
-			SELECT username, updated_at 
+			SELECT username, flow_type, updated_at 
 			FROM oauth_sessions 
 			WHERE client_id = ? AND status = 'consumed' AND updated_at >= ? AND updated_at < ?
 			ORDER BY updated_at DESC`
@@ -1095,7 +1175,7 @@ func GetAppHistory(appID string, dateStr string, offsetMinutes int) ([]types.Log
 	} else {
 		// Default history (last 10)
 		query = `
-			SELECT username, updated_at 
+			SELECT username, flow_type, updated_at 
 			FROM oauth_sessions 
 			WHERE client_id = ? AND status = 'consumed'
 			ORDER BY updated_at DESC LIMIT 10`
@@ -1111,10 +1191,14 @@ func GetAppHistory(appID string, dateStr string, offsetMinutes int) ([]types.Log
 	for rows.Next() {
 		var item types.LoginHistoryItem
 		var user sql.NullString
-		if err := rows.Scan(&user, &item.Timestamp); err != nil {
+		var flowType string
+		if err := rows.Scan(&user, &flowType, &item.Timestamp); err != nil {
 			return nil, err
 		}
 		item.User = user.String
+		if flowType == "client_credentials" {
+			item.Grant = flowType
+		}
 		history = append(history, item)
 	}
 
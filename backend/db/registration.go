@@ -0,0 +1,259 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"mirpass-backend/config"
+	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"strings"
+	"time"
+)
+
+var ErrInvalidInitialAccessToken = errors.New("invalid initial access token")
+
+// CanMintInitialAccessTokens reports whether the user may hand out client registration
+// rights: system admins, and roots of any app.
+func CanMintInitialAccessTokens(username string) (bool, error) {
+	var count int
+	err := database.QueryRow(`SELECT COUNT(*) FROM admins WHERE username = ? AND (role = 'root' OR (app = 'system' AND role = 'admin'))`, username).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func CreateInitialAccessToken(createdBy string, name string, maxUses *int, expiresAt time.Time) (*types.InitialAccessToken, error) {
+	token := "iat_" + utils.GenerateToken()
+	res, err := database.Exec(`INSERT INTO initial_access_tokens (token_hash, name, created_by, max_uses, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		utils.Sha256(token), name, createdBy, maxUses, expiresAt.UTC())
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+
+	return &types.InitialAccessToken{
+		ID:        id,
+		Token:     token,
+		Name:      name,
+		CreatedBy: createdBy,
+		MaxUses:   maxUses,
+		Status:    "active",
+		ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+func ListInitialAccessTokens(createdBy string) ([]types.InitialAccessToken, error) {
+	rows, err := database.Query(`SELECT id, name, created_by, max_uses, uses, status, expires_at, last_used_at, created_at FROM initial_access_tokens WHERE created_by = ? ORDER BY created_at DESC`, createdBy)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []types.InitialAccessToken
+	for rows.Next() {
+		var t types.InitialAccessToken
+		var name, lastUsedAt sql.NullString
+		var maxUses sql.NullInt64
+		if err := rows.Scan(&t.ID, &name, &t.CreatedBy, &maxUses, &t.Uses, &t.Status, &t.ExpiresAt, &lastUsedAt, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.Name = name.String
+		t.LastUsedAt = lastUsedAt.String
+		if maxUses.Valid {
+			v := int(maxUses.Int64)
+			t.MaxUses = &v
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func RevokeInitialAccessToken(id int64, createdBy string) error {
+	res, err := database.Exec(`UPDATE initial_access_tokens SET status = 'revoked' WHERE id = ? AND created_by = ?`, id, createdBy)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetInitialAccessTokenOwner returns who minted a usable initial access token.
+func GetInitialAccessTokenOwner(token string) (string, error) {
+	var owner string
+	err := database.QueryRow(`SELECT created_by FROM initial_access_tokens
+		WHERE token_hash = ? AND status = 'active' AND expires_at > UTC_TIMESTAMP() AND (max_uses IS NULL OR uses < max_uses)`,
+		utils.Sha256(token)).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidInitialAccessToken
+	}
+	return owner, err
+}
+
+// RegisterClient spends one use of the initial access token and creates the app, its trusted
+// URIs and, for confidential clients, a secret, all in one transaction. The token's creator
+// becomes the app's root. The returned information carries the plain secret and registration
+// access token, which are only stored hashed.
+func RegisterClient(initialToken string, meta types.ClientMetadata) (*types.ClientInformation, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	iatHash := utils.Sha256(initialToken)
+	res, err := tx.Exec(`UPDATE initial_access_tokens SET uses = uses + 1, last_used_at = UTC_TIMESTAMP()
+		WHERE token_hash = ? AND status = 'active' AND expires_at > UTC_TIMESTAMP() AND (max_uses IS NULL OR uses < max_uses)`, iatHash)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return nil, ErrInvalidInitialAccessToken
+	}
+	var owner string
+	if err := tx.QueryRow(`SELECT created_by FROM initial_access_tokens WHERE token_hash = ?`, iatHash).Scan(&owner); err != nil {
+		return nil, err
+	}
+
+	id := utils.GenerateID()
+	if meta.ClientName == "" {
+		meta.ClientName = "Registered client " + id
+	}
+	registrationToken := "rat_" + utils.GenerateToken()
+	_, err = tx.Exec(`INSERT INTO applications (id, name, description, device_code_enabled, allowed_grant_types, require_par, require_signed_request, backchannel_logout_uri, jwks, token_endpoint_auth_method, tls_client_subject_dn, tls_client_cert_thumbprint, registration_token_hash)
+		VALUES (?, ?, '', ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, NULLIF(?, ''), NULLIF(?, ''), ?)`,
+		id, meta.ClientName, usesDeviceCode(meta.GrantTypes), strings.Join(meta.GrantTypes, " "), meta.RequirePAR, meta.RequireSignedRequest,
+		meta.BackchannelLogoutURI, string(meta.JWKS), meta.TokenEndpointAuthMethod, meta.TLSClientAuthSubjectDN, meta.TLSClientCertThumbprint, utils.Sha256(registrationToken))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec("INSERT INTO admins (username, app, role) VALUES (?, ?, 'root')", owner, id); err != nil {
+		return nil, err
+	}
+	if err = insertRegisteredURIs(tx, id, meta.RedirectURIs); err != nil {
+		return nil, err
+	}
+
+	info := &types.ClientInformation{
+		ClientID:                id,
+		ClientIDIssuedAt:        time.Now().Unix(),
+		RegistrationAccessToken: registrationToken,
+		ClientMetadata:          meta,
+	}
+	if needsSecret(meta.TokenEndpointAuthMethod) {
+		if info.ClientSecret, err = insertRegisteredSecret(tx, id); err != nil {
+			return nil, err
+		}
+		var never int64
+		info.ClientSecretExpiresAt = &never
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// UpdateRegisteredClient replaces a registered client's metadata. A client switching to a
+// secret-based method without a secret gets a new one, which is returned; switching to "none",
+// private_key_jwt or either TLS method deletes its secrets.
+func UpdateRegisteredClient(clientID string, meta types.ClientMetadata) (string, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE applications SET name = COALESCE(NULLIF(?, ''), name), device_code_enabled = ?, allowed_grant_types = ?, require_par = ?, require_signed_request = ?,
+		backchannel_logout_uri = NULLIF(?, ''), jwks = NULLIF(?, ''), token_endpoint_auth_method = ?,
+		tls_client_subject_dn = NULLIF(?, ''), tls_client_cert_thumbprint = NULLIF(?, '') WHERE id = ?`,
+		meta.ClientName, usesDeviceCode(meta.GrantTypes), strings.Join(meta.GrantTypes, " "), meta.RequirePAR, meta.RequireSignedRequest,
+		meta.BackchannelLogoutURI, string(meta.JWKS), meta.TokenEndpointAuthMethod, meta.TLSClientAuthSubjectDN, meta.TLSClientCertThumbprint, clientID)
+	if err != nil {
+		return "", err
+	}
+	if _, err = tx.Exec("DELETE FROM trusted_uris WHERE app_id = ?", clientID); err != nil {
+		return "", err
+	}
+	if err = insertRegisteredURIs(tx, clientID, meta.RedirectURIs); err != nil {
+		return "", err
+	}
+
+	var secret string
+	if !needsSecret(meta.TokenEndpointAuthMethod) {
+		if _, err = tx.Exec("DELETE FROM app_secrets WHERE app_id = ?", clientID); err != nil {
+			return "", err
+		}
+	} else {
+		var count int
+		if err = tx.QueryRow("SELECT COUNT(*) FROM app_secrets WHERE app_id = ?", clientID).Scan(&count); err != nil {
+			return "", err
+		}
+		if count == 0 {
+			if secret, err = insertRegisteredSecret(tx, clientID); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return secret, tx.Commit()
+}
+
+// ValidateRegistrationToken checks a registration access token against the client it was issued for.
+func ValidateRegistrationToken(clientID string, token string) bool {
+	var count int
+	err := database.QueryRow(`SELECT COUNT(*) FROM applications WHERE id = ? AND registration_token_hash = ?`, clientID, utils.Sha256(token)).Scan(&count)
+	return err == nil && count > 0
+}
+
+func HasAppSecrets(appID string) (bool, error) {
+	var count int
+	if err := database.QueryRow("SELECT COUNT(*) FROM app_secrets WHERE app_id = ?", appID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// needsSecret reports whether a token endpoint auth method is based on a client secret.
+func needsSecret(method string) bool {
+	return method != "none" && method != "private_key_jwt" && method != "tls_client_auth" && method != "self_signed_tls_client_auth"
+}
+
+func usesDeviceCode(grantTypes []string) bool {
+	for _, g := range grantTypes {
+		if g == "urn:ietf:params:oauth:grant-type:device_code" {
+			return true
+		}
+	}
+	return false
+}
+
+func insertRegisteredURIs(tx *sql.Tx, appID string, uris []string) error {
+	for _, uri := range uris {
+		kind, err := utils.ClassifyRedirectURI(uri)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO trusted_uris (app_id, name, uri, kind) VALUES (?, 'Registered', ?, ?)", appID, uri, kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertRegisteredSecret(tx *sql.Tx, appID string) (string, error) {
+	secret := utils.GenerateApiKey()
+	encrypted, err := utils.EncryptSecret([]byte(secret), config.AppConfig.SigningKeySecret)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("INSERT INTO app_secrets (app_id, name, secret_hash, secret_encrypted) VALUES (?, 'Registration', ?, ?)", appID, utils.Sha256(secret), encrypted)
+	return secret, err
+}
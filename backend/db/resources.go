@@ -0,0 +1,78 @@
+package db
+
+import (
+	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"strings"
+)
+
+func scanAPIResources(query string, args ...interface{}) ([]types.APIResource, error) {
+	rows, err := database.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resources := []types.APIResource{}
+	for rows.Next() {
+		var res types.APIResource
+		var scopes string
+		if err := rows.Scan(&res.ID, &res.AppID, &res.Identifier, &res.Name, &scopes, &res.CreatedAt); err != nil {
+			return nil, err
+		}
+		res.Scopes = strings.Fields(scopes)
+		resources = append(resources, res)
+	}
+	return resources, rows.Err()
+}
+
+func ListAPIResources(appID string) ([]types.APIResource, error) {
+	return scanAPIResources(`SELECT id, app_id, identifier, name, scopes, created_at FROM api_resources WHERE app_id = ? ORDER BY created_at`, appID)
+}
+
+// GetAPIResourcesByIdentifier looks up resources by their identifiers. Unknown identifiers are skipped.
+func GetAPIResourcesByIdentifier(identifiers []string) ([]types.APIResource, error) {
+	if len(identifiers) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(identifiers))
+	for i, id := range identifiers {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(identifiers)), ", ")
+	return scanAPIResources(`SELECT id, app_id, identifier, name, scopes, created_at FROM api_resources WHERE identifier IN (`+placeholders+`)`, args...)
+}
+
+func CreateAPIResource(appID string, identifier string, name string, scopes []string) (*types.APIResource, error) {
+	id := utils.GenerateID()
+	if _, err := database.Exec(`INSERT INTO api_resources (id, app_id, identifier, name, scopes) VALUES (?, ?, ?, ?, ?)`, id, appID, identifier, name, strings.Join(scopes, " ")); err != nil {
+		return nil, err
+	}
+	return &types.APIResource{ID: id, AppID: appID, Identifier: identifier, Name: name, Scopes: scopes}, nil
+}
+
+// UpdateAPIResource renames a resource and replaces its scopes. The identifier cannot change,
+// since issued tokens carry it as their audience.
+func UpdateAPIResource(appID string, resourceID string, name string, scopes []string) error {
+	_, err := database.Exec(`UPDATE api_resources SET name = ?, scopes = ? WHERE id = ? AND app_id = ?`, name, strings.Join(scopes, " "), resourceID, appID)
+	return err
+}
+
+func DeleteAPIResource(appID string, resourceID string) error {
+	_, err := database.Exec(`DELETE FROM api_resources WHERE id = ? AND app_id = ?`, resourceID, appID)
+	return err
+}
+
+// OwnsAnyResource reports whether one of the identifiers is a resource registered by the app.
+func OwnsAnyResource(appID string, identifiers []string) (bool, error) {
+	resources, err := GetAPIResourcesByIdentifier(identifiers)
+	if err != nil {
+		return false, err
+	}
+	for _, res := range resources {
+		if res.AppID == appID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
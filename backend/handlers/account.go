@@ -146,7 +146,7 @@ func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task, err := db.VerifyUserByToken(token)
+	username, task, err := db.VerifyUserByToken(token)
 	if err != nil {
 		WriteErrorResponse(w, 400, "Invalid or expired token")
 		return
@@ -158,6 +158,7 @@ func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
 	case "change_email":
 		WriteSuccessResponse(w, "Email successfully changed", nil)
 	case "reset_password":
+		endUserSessions(username, "password_change", true)
 		WriteSuccessResponse(w, "Password successfully reset", nil)
 	default:
 		WriteSuccessResponse(w, "Verification successful", nil)
@@ -73,6 +73,9 @@ func AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Sessions are looked up by username, so notify apps while the user still exists
+	endUserSessions(username, "account_deleted", true)
+
 	err := db.DeleteUser(username)
 	if err != nil {
 		WriteErrorResponse(w, 500, "Could not delete user")
@@ -139,6 +142,7 @@ func AdminResetPassword(w http.ResponseWriter, r *http.Request) {
 		WriteErrorResponse(w, 500, "Update failed")
 		return
 	}
+	endUserSessions(body.Username, "password_change", true)
 
 	WriteSuccessResponse(w, "Password reset successfully", nil)
 }
@@ -78,3 +78,32 @@ func AdminSuspendApp(w http.ResponseWriter, r *http.Request) {
 
 	WriteSuccessResponse(w, "App suspension updated", nil)
 }
+
+// AdminSetFirstParty marks an app as first-party, which skips the consent screen for it.
+func AdminSetFirstParty(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		AppID      string `json:"appId"`
+		FirstParty bool   `json:"firstParty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.AppID == "" {
+		WriteErrorResponse(w, http.StatusBadRequest, "App ID is required")
+		return
+	}
+
+	if err := db.UpdateAppFirstParty(req.AppID, req.FirstParty); err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Failed to update app")
+		return
+	}
+
+	WriteSuccessResponse(w, "App updated", nil)
+}
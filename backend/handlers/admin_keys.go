@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"mirpass-backend/db"
+)
+
+func RootListSigningKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := db.ListSigningKeys()
+	if err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Failed to list signing keys")
+		return
+	}
+	WriteSuccessResponse(w, "Signing keys fetched", keys)
+}
+
+func RootRotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, err := db.RotateSigningKey()
+	if err != nil {
+		if errors.Is(err, db.ErrKeysManagedByFiles) {
+			WriteErrorResponse(w, http.StatusConflict, err.Error())
+			return
+		}
+		WriteErrorResponse(w, http.StatusInternalServerError, "Failed to rotate signing key")
+		return
+	}
+	WriteSuccessResponse(w, "Signing key rotated", key)
+}
+
+func RootRetireSigningKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		KeyID string `json:"kid"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.KeyID == "" {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	err := db.RetireSigningKey(req.KeyID)
+	if err != nil {
+		if errors.Is(err, db.ErrKeysManagedByFiles) {
+			WriteErrorResponse(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err == sql.ErrNoRows {
+			WriteErrorResponse(w, http.StatusNotFound, "Signing key not found")
+			return
+		}
+		WriteErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	WriteSuccessResponse(w, "Signing key retired", nil)
+}
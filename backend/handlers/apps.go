@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
+	"slices"
 	"strings"
 
 	"mirpass-backend/config"
@@ -143,13 +143,17 @@ func AddAppTrustedURIHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := url.ParseRequestURI(req.URI)
-	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
-		WriteErrorResponse(w, http.StatusBadRequest, "Invalid URI")
+	kind, err := utils.ClassifyRedirectURI(req.URI)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid URI: "+err.Error())
+		return
+	}
+	if req.Kind != "" && req.Kind != kind {
+		WriteErrorResponse(w, http.StatusBadRequest, "URI is a "+kind+" URI, not "+req.Kind)
 		return
 	}
 
-	id, err := db.AddTrustedURI(req.AppID, req.Name, req.URI)
+	id, err := db.AddTrustedURI(req.AppID, req.Name, req.URI, kind)
 	if err != nil {
 		if strings.Contains(err.Error(), "already exists") {
 			WriteErrorResponse(w, http.StatusBadRequest, "Trusted URI already exists")
@@ -308,6 +312,9 @@ func UpdateAppHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var appID, name, description, logoURL string
+	var policyJSON []byte
+	var backchannelURI *string
+	var jwks *string
 
 	contentType := r.Header.Get("Content-Type")
 	if strings.HasPrefix(contentType, "multipart/form-data") {
@@ -321,6 +328,13 @@ func UpdateAppHandler(w http.ResponseWriter, r *http.Request) {
 		name = r.FormValue("name")
 		description = r.FormValue("description")
 		logoURL = r.FormValue("logoUrl")
+		policyJSON = []byte(r.FormValue("policy"))
+		if v, ok := r.MultipartForm.Value["backchannelLogoutUri"]; ok && len(v) > 0 {
+			backchannelURI = &v[0]
+		}
+		if v, ok := r.MultipartForm.Value["jwks"]; ok && len(v) > 0 {
+			jwks = &v[0]
+		}
 
 		// Check access early
 		isAdmin, err := db.IsAppAdmin(claims.Username, appID)
@@ -354,6 +368,9 @@ func UpdateAppHandler(w http.ResponseWriter, r *http.Request) {
 		name = req.Name
 		description = req.Description
 		logoURL = req.LogoURL
+		policyJSON = req.Policy
+		backchannelURI = req.BackchannelLogoutURI
+		jwks = req.JWKS
 
 		isAdmin, err := db.IsAppAdmin(claims.Username, appID)
 		if err != nil || !isAdmin {
@@ -370,6 +387,39 @@ func UpdateAppHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	oldLogo := oldApp.LogoURL
 
+	// Fields missing from the policy object keep their current values
+	policy := oldApp.Policy
+	if len(policyJSON) > 0 {
+		if err := json.Unmarshal(policyJSON, &policy); err != nil {
+			WriteErrorResponse(w, http.StatusBadRequest, "Invalid policy")
+			return
+		}
+		if msg := validateAppPolicy(&policy); msg != "" {
+			WriteErrorResponse(w, http.StatusBadRequest, msg)
+			return
+		}
+	}
+	if backchannelURI != nil && *backchannelURI != "" {
+		if msg := validateBackchannelLogoutURI(*backchannelURI); msg != "" {
+			WriteErrorResponse(w, http.StatusBadRequest, msg)
+			return
+		}
+	}
+	keys := oldApp.JWKS
+	if jwks != nil {
+		keys = strings.TrimSpace(*jwks)
+		if keys != "" {
+			if _, err := utils.ParseClientJWKS(keys); err != nil {
+				WriteErrorResponse(w, http.StatusBadRequest, "Invalid jwks: "+err.Error())
+				return
+			}
+		}
+	}
+	if policy.RequireSignedRequest && keys == "" {
+		WriteErrorResponse(w, http.StatusBadRequest, "requireSignedRequest needs a registered jwks")
+		return
+	}
+
 	if logoURL != config.AppConfig.BackendURL+oldLogo {
 		// External URL blob
 		if strings.HasPrefix(logoURL, "http") {
@@ -397,9 +447,67 @@ func UpdateAppHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(policyJSON) > 0 {
+		if err := db.UpdateAppPolicy(appID, policy); err != nil {
+			WriteErrorResponse(w, http.StatusInternalServerError, "Could not update app policy")
+			return
+		}
+	}
+	if backchannelURI != nil {
+		if err := db.UpdateAppBackchannelLogoutURI(appID, *backchannelURI); err != nil {
+			WriteErrorResponse(w, http.StatusInternalServerError, "Could not update back-channel logout URI")
+			return
+		}
+	}
+	if jwks != nil {
+		if err := db.UpdateAppJWKS(appID, keys); err != nil {
+			WriteErrorResponse(w, http.StatusInternalServerError, "Could not update jwks")
+			return
+		}
+	}
+
 	WriteSuccessResponse(w, "App updated", nil)
 }
 
+// validateAppPolicy checks the policy bounds and deduplicates the grant types.
+// It returns a message for the client, or "" when the policy is acceptable.
+func validateAppPolicy(p *types.AppPolicy) string {
+	const day = 24 * 60 * 60
+	switch {
+	case p.AccessTokenLifetime < 60 || p.AccessTokenLifetime > int(utils.MaxAccessTokenLifetime.Seconds()):
+		return "accessTokenLifetime must be between 60 seconds and 30 days"
+	case p.IDTokenLifetime < 60 || p.IDTokenLifetime > day:
+		return "idTokenLifetime must be between 60 seconds and 1 day"
+	case p.RefreshTokenLifetime < 3600 || p.RefreshTokenLifetime > 365*day:
+		return "refreshTokenLifetime must be between 1 hour and 365 days"
+	case p.DeviceCodeLifetime < 60 || p.DeviceCodeLifetime > 3600:
+		return "deviceCodeLifetime must be between 60 and 3600 seconds"
+	case p.DevicePollInterval < 1 || p.DevicePollInterval > 60:
+		return "devicePollInterval must be between 1 and 60 seconds"
+	case utils.UserCodeAlphabets[p.UserCodeAlphabet] == "":
+		return "userCodeAlphabet must be alphanumeric, base20 or numeric"
+	case p.UserCodeLength < 6 || p.UserCodeLength > 16:
+		return "userCodeLength must be between 6 and 16"
+	case p.UserCodeAlphabet == "numeric" && p.UserCodeLength < 8:
+		return "Numeric user codes must be at least 8 digits"
+	}
+
+	var grants []string
+	for _, g := range p.AllowedGrantTypes {
+		if !slices.Contains(supportedGrantTypes, g) {
+			return "Unsupported grant type: " + g
+		}
+		if !slices.Contains(grants, g) {
+			grants = append(grants, g)
+		}
+	}
+	if len(grants) == 0 {
+		return "At least one grant type must be allowed"
+	}
+	p.AllowedGrantTypes = grants
+	return ""
+}
+
 func UpdateDeviceCodeEnabledHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -435,6 +543,59 @@ func UpdateDeviceCodeEnabledHandler(w http.ResponseWriter, r *http.Request) {
 	WriteSuccessResponse(w, "Device code flow setting updated", nil)
 }
 
+// UpdateAppTLSClientAuthHandler sets how the app may authenticate with a client certificate.
+// The certificate may be given as PEM or as its x5t#S256 thumbprint; empty values turn the
+// corresponding method off.
+func UpdateAppTLSClientAuthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		AppID       string `json:"appId"`
+		Certificate string `json:"certificate"`
+		SubjectDN   string `json:"subjectDn"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	isAdmin, err := db.IsAppAdmin(claims.Username, req.AppID)
+	if err != nil || !isAdmin {
+		WriteErrorResponse(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	var thumbprint string
+	if strings.TrimSpace(req.Certificate) != "" {
+		thumbprint, err = utils.ParseCertThumbprint(req.Certificate)
+		if err != nil {
+			WriteErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	subjectDN := strings.TrimSpace(req.SubjectDN)
+	if len(subjectDN) > 512 {
+		WriteErrorResponse(w, http.StatusBadRequest, "Subject DN is too long")
+		return
+	}
+
+	if err := db.UpdateAppTLSClientAuth(req.AppID, thumbprint, subjectDN); err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Could not update TLS client authentication")
+		return
+	}
+
+	WriteSuccessResponse(w, "TLS client authentication updated", map[string]string{"thumbprint": thumbprint, "subjectDn": subjectDN})
+}
+
 func GetAppStatsHandler(w http.ResponseWriter, r *http.Request) {
 	appID := r.URL.Query().Get("id")
 	if appID == "" {
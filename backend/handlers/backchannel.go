@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mirpass-backend/config"
+	"mirpass-backend/db"
+	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// backchannelRetryDelays is the wait after each failed attempt; once exhausted the delivery is marked failed.
+var backchannelRetryDelays = []time.Duration{30 * time.Second, 2 * time.Minute, 10 * time.Minute, 30 * time.Minute, 2 * time.Hour}
+
+var backchannelClient = &http.Client{
+	Timeout: 10 * time.Second,
+	// No proxy, so the address checked is the one connected to
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: refuseInternalAddress}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	// The spec forbids following redirects from the logout endpoint
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var backchannelWake = make(chan struct{}, 1)
+
+// endUserSessions tells every app the user is still signed into that the session is over.
+// With revokeRefresh, refresh tokens are revoked too so apps cannot quietly sign back in.
+func endUserSessions(username string, reason string, revokeRefresh bool) {
+	// Targets are found through active refresh tokens, so collect them before revoking
+	targets, err := db.GetBackchannelLogoutTargets(username)
+	if err != nil {
+		log.Println("Error listing back-channel logout targets:", err)
+	}
+	for _, t := range targets {
+		if err := db.CreateBackchannelDelivery(t.ClientID, username, t.SID, reason); err != nil {
+			log.Printf("Error queueing back-channel logout for %s: %v", t.ClientID, err)
+		}
+	}
+
+	if revokeRefresh {
+		if err := db.RevokeUserRefreshTokens(username); err != nil {
+			log.Println("Error revoking refresh tokens:", err)
+		}
+	}
+
+	if len(targets) > 0 {
+		select {
+		case backchannelWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// RunBackchannelLogoutWorker delivers queued logout tokens, waking early when new ones are queued.
+func RunBackchannelLogoutWorker() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		deliverDueBackchannelLogouts()
+		select {
+		case <-ticker.C:
+		case <-backchannelWake:
+		}
+	}
+}
+
+func deliverDueBackchannelLogouts() {
+	const batch = 50
+	for {
+		deliveries, err := db.GetDueBackchannelDeliveries(batch)
+		if err != nil {
+			log.Println("Error loading back-channel logout deliveries:", err)
+			return
+		}
+		for _, d := range deliveries {
+			if ok, err := db.ClaimBackchannelDelivery(d.ID); err != nil || !ok {
+				continue
+			}
+			deliverBackchannelLogout(d)
+		}
+		if len(deliveries) < batch {
+			return
+		}
+	}
+}
+
+func deliverBackchannelLogout(d types.BackchannelDelivery) {
+	err := postLogoutToken(d)
+	if err == nil {
+		if err := db.MarkBackchannelDelivered(d.ID); err != nil {
+			log.Println("Error recording back-channel logout delivery:", err)
+		}
+		return
+	}
+
+	var retryAt *time.Time
+	if d.Attempts < len(backchannelRetryDelays) {
+		t := time.Now().Add(backchannelRetryDelays[d.Attempts])
+		retryAt = &t
+	}
+	if err := db.MarkBackchannelAttemptFailed(d.ID, err.Error(), retryAt); err != nil {
+		log.Println("Error recording back-channel logout failure:", err)
+	}
+}
+
+func postLogoutToken(d types.BackchannelDelivery) error {
+	if d.URI == "" {
+		return errors.New("app no longer has a backchannel_logout_uri")
+	}
+
+	// Signed per attempt: logout tokens are short-lived and retries can span hours
+	token, err := utils.GenerateLogoutToken(d.ClientID, d.Username, d.SID)
+	if err != nil {
+		return err
+	}
+
+	resp, err := backchannelClient.PostForm(d.URI, url.Values{"logout_token": {token}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded with HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// validateBackchannelLogoutURI requires an absolute https URL whose host resolves to public
+// addresses only. Local development may use plain http to localhost and private addresses.
+func validateBackchannelLogoutURI(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return "backchannelLogoutUri must be an absolute URL"
+	}
+	if u.Fragment != "" {
+		return "backchannelLogoutUri must not contain a fragment"
+	}
+	host := u.Hostname()
+	dev := config.AppConfig.DevMode
+	if u.Scheme != "https" && !(dev && u.Scheme == "http" && (host == "localhost" || host == "127.0.0.1" || host == "::1")) {
+		return "backchannelLogoutUri must use https"
+	}
+	if dev {
+		return ""
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return "backchannelLogoutUri host cannot be resolved"
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return "backchannelLogoutUri must not point to a local or private address"
+		}
+	}
+	return ""
+}
+
+// refuseInternalAddress stops logout deliveries to loopback, private and link-local
+// addresses. It checks the address being dialled, so a host that resolved to a public
+// address when the URI was saved cannot be pointed inside later.
+func refuseInternalAddress(network string, address string, _ syscall.RawConn) error {
+	if config.AppConfig.DevMode {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("refusing to connect to internal address %s", host)
+	}
+	return nil
+}
+
+// publicIP reports whether ip is a globally routable unicast address.
+func publicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+func GetBackchannelDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	appID := r.URL.Query().Get("id")
+	if appID == "" {
+		WriteErrorResponse(w, http.StatusBadRequest, "App ID is required")
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	isAdmin, err := db.IsAppAdmin(claims.Username, appID)
+	if err != nil || !isAdmin {
+		WriteErrorResponse(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	deliveries, err := db.ListBackchannelDeliveries(appID)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Failed to get deliveries")
+		return
+	}
+	WriteSuccessResponse(w, "Back-channel logout deliveries", deliveries)
+}
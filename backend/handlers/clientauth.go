@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"log"
+	"mirpass-backend/config"
+	"mirpass-backend/db"
+	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// hasClientAssertion reports whether the client is authenticating with a JWT (RFC 7523).
+func hasClientAssertion(r *http.Request) bool {
+	return r.Form.Get("client_assertion") != "" || r.Form.Get("client_assertion_type") != ""
+}
+
+// authenticateClientAssertion verifies a private_key_jwt or client_secret_jwt assertion and
+// returns the client and the method used. HMAC assertions are checked against the app's
+// secrets, the rest against its registered JWKS. Each assertion is accepted once; its jti
+// is remembered until it expires.
+func authenticateClientAssertion(r *http.Request) (string, string, error) {
+	if r.Form.Get("client_assertion_type") != utils.ClientAssertionType {
+		return "", "", errInvalidClient
+	}
+	assertion := r.Form.Get("client_assertion")
+	if assertion == "" || r.Form.Get("client_secret") != "" {
+		return "", "", errInvalidClient
+	}
+	if _, _, ok := r.BasicAuth(); ok {
+		return "", "", errInvalidClient
+	}
+
+	// The issuer names the client; the signature is checked below against that client's keys
+	unverified, _, err := jwt.NewParser().ParseUnverified(assertion, jwt.MapClaims{})
+	if err != nil {
+		return "", "", errInvalidClient
+	}
+	claims := unverified.Claims.(jwt.MapClaims)
+	clientID, _ := claims["iss"].(string)
+	if sub, _ := claims["sub"].(string); clientID == "" || sub != clientID || clientID == "system" {
+		return "", "", errInvalidClient
+	}
+	if id := r.Form.Get("client_id"); id != "" && id != clientID {
+		return "", "", errInvalidClient
+	}
+
+	app, err := db.GetApplication(clientID)
+	if err != nil {
+		return "", "", errInvalidClient
+	}
+
+	// The audience is the issuer or the URL of the endpoint being called
+	issuer := strings.TrimSuffix(config.AppConfig.BackendURL, "/")
+	opts := []jwt.ParserOption{
+		jwt.WithIssuer(clientID),
+		jwt.WithSubject(clientID),
+		jwt.WithAudience(issuer, issuer+r.URL.Path),
+		jwt.WithExpirationRequired(),
+	}
+
+	var verified jwt.MapClaims
+	method := "private_key_jwt"
+	if slices.Contains(utils.ClientSecretJWTAlgs, unverified.Method.Alg()) {
+		method = "client_secret_jwt"
+		secrets, err := db.GetAppSecretKeys(app.ID)
+		if err != nil {
+			log.Println("Error loading app secrets:", err)
+			return "", "", errInvalidClient
+		}
+		verified, err = utils.VerifyClientSecretJWT(assertion, secrets, opts...)
+		if err != nil {
+			return "", "", errInvalidClient
+		}
+	} else {
+		if app.JWKS == "" {
+			return "", "", errInvalidClient
+		}
+		verified, err = utils.VerifyClientJWT(assertion, app.JWKS, opts...)
+		if err != nil {
+			return "", "", errInvalidClient
+		}
+	}
+
+	jti, _ := verified["jti"].(string)
+	exp, err := verified.GetExpirationTime()
+	if jti == "" || err != nil || exp == nil {
+		return "", "", errInvalidClient
+	}
+	fresh, err := db.MarkJTIUsed("client_assertion:"+clientID, jti, exp.Time.Add(time.Minute))
+	if err != nil {
+		log.Println("Error recording client assertion:", err)
+		return "", "", errInvalidClient
+	}
+	if !fresh {
+		return "", "", errInvalidClient
+	}
+	return clientID, method, nil
+}
+
+// clientAuthMethods are the ways a confidential client can authenticate at the token,
+// revocation, introspection and PAR endpoints.
+var clientAuthMethods = []string{"client_secret_basic", "client_secret_post", "client_secret_jwt", "private_key_jwt", "tls_client_auth", "self_signed_tls_client_auth"}
+
+// clientCertThumbprint returns the x5t#S256 thumbprint of the request's client certificate
+// when it authenticates the app (RFC 8705): either it is the pinned certificate, or it
+// chains to the trusted client CAs and has the registered subject DN. Otherwise it is "".
+func clientCertThumbprint(r *http.Request, app *types.Application) string {
+	thumbprint, _ := matchClientCert(r, app)
+	return thumbprint
+}
+
+// matchClientCert is clientCertThumbprint that also names the method the certificate
+// satisfied: self_signed_tls_client_auth for a pinned certificate, tls_client_auth for a
+// subject DN under the client CA.
+func matchClientCert(r *http.Request, app *types.Application) (string, string) {
+	if app.TLSClientCertThumbprint == "" && app.TLSClientSubjectDN == "" {
+		return "", ""
+	}
+	certs := utils.ClientCertificates(r)
+	if len(certs) == 0 {
+		return "", ""
+	}
+	thumbprint := utils.CertThumbprint(certs[0])
+	if app.TLSClientCertThumbprint != "" && subtle.ConstantTimeCompare([]byte(thumbprint), []byte(app.TLSClientCertThumbprint)) == 1 {
+		return thumbprint, "self_signed_tls_client_auth"
+	}
+	if app.TLSClientSubjectDN != "" && certs[0].Subject.String() == app.TLSClientSubjectDN && utils.VerifyClientCertChain(certs) {
+		return thumbprint, "tls_client_auth"
+	}
+	return "", ""
+}
+
+// clientIsConfidential reports whether the app has credentials to authenticate with, and
+// so must use them: secrets, a JWKS, a certificate binding or a registered method other
+// than none.
+func clientIsConfidential(app *types.Application) (bool, error) {
+	if app.JWKS != "" || app.TLSClientCertThumbprint != "" || app.TLSClientSubjectDN != "" {
+		return true, nil
+	}
+	if app.TokenEndpointAuthMethod != "" && app.TokenEndpointAuthMethod != "none" {
+		return true, nil
+	}
+	return db.HasAppSecrets(app.ID)
+}
+
+// confirmation builds the cnf claim binding an access token to the client's certificate
+// and/or DPoP key, or nil for a plain bearer token.
+func confirmation(certThumbprint string, dpopJKT string) map[string]string {
+	if certThumbprint == "" && dpopJKT == "" {
+		return nil
+	}
+	cnf := map[string]string{}
+	if certThumbprint != "" {
+		cnf["x5t#S256"] = certThumbprint
+	}
+	if dpopJKT != "" {
+		cnf["jkt"] = dpopJKT
+	}
+	return cnf
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"mirpass-backend/config"
+	"mirpass-backend/db"
+	"mirpass-backend/utils"
+	"net/http"
+	"strings"
+)
+
+const dpopJKTKey contextKey = "dpopJkt"
+
+// checkDPoPProof validates the DPoP header of the request (RFC 9449) and returns the proof
+// key's thumbprint. On failure it returns the error code for the client: use_dpop_nonce
+// when only a fresh nonce is missing, invalid_dpop_proof otherwise.
+func checkDPoPProof(r *http.Request, accessToken string) (string, string) {
+	headers := r.Header.Values("DPoP")
+	if len(headers) != 1 {
+		return "", "invalid_dpop_proof"
+	}
+
+	uri := strings.TrimSuffix(config.AppConfig.BackendURL, "/") + r.URL.Path
+	proof, err := utils.VerifyDPoPProof(headers[0], r.Method, uri, accessToken)
+	if err != nil && config.AppConfig.MTLSBackendURL != "" {
+		// The TLS listener has its own public URL
+		proof, err = utils.VerifyDPoPProof(headers[0], r.Method, strings.TrimSuffix(config.AppConfig.MTLSBackendURL, "/")+r.URL.Path, accessToken)
+	}
+	if err != nil {
+		return "", "invalid_dpop_proof"
+	}
+	if !utils.ValidDPoPNonce(proof.Nonce) {
+		return "", "use_dpop_nonce"
+	}
+
+	fresh, err := db.MarkJTIUsed("dpop:"+proof.JKT, proof.JTI, proof.IssuedAt.Add(2*utils.DPoPProofLifetime))
+	if err != nil {
+		log.Println("Error recording DPoP proof:", err)
+		return "", "invalid_dpop_proof"
+	}
+	if !fresh {
+		return "", "invalid_dpop_proof"
+	}
+	return proof.JKT, ""
+}
+
+// withDPoPKey remembers the verified proof key for the grant handlers.
+func withDPoPKey(r *http.Request, jkt string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), dpopJKTKey, jkt))
+}
+
+// dpopKey returns the thumbprint of the token request's DPoP key, or "" without a proof.
+func dpopKey(r *http.Request) string {
+	jkt, _ := r.Context().Value(dpopJKTKey).(string)
+	return jkt
+}
+
+// tokenType is DPoP for tokens bound to a proof key and Bearer otherwise.
+func tokenType(jkt string) string {
+	if jkt != "" {
+		return "DPoP"
+	}
+	return "Bearer"
+}
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"mirpass-backend/db"
+	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const accessTokenType = "urn:ietf:params:oauth:token-type:access_token"
+
+// TokenExchangeGrantHandler implements RFC 8693 token exchange. A confidential client trades
+// a user's access token for a token addressed to another app, with the same or fewer scopes.
+// The audience app's admins decide which clients may do so. The issued token's act claim
+// names the actor: the subject of actor_token, or the client itself.
+func TokenExchangeGrantHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, authenticated, err := authenticateClient(r)
+	if err != nil || !authenticated || clientID == "system" {
+		WriteOauthErrorResponse(w, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	app, err := db.GetApplication(clientID)
+	if err != nil {
+		WriteOauthErrorResponse(w, "invalid_client", "Unknown client")
+		return
+	}
+	if !grantAllowed(app, tokenExchangeGrantType) || appSuspended(app) {
+		WriteOauthErrorResponse(w, "unauthorized_client", "Token exchange is not allowed for this application")
+		return
+	}
+
+	subjectToken := r.Form.Get("subject_token")
+	if subjectToken == "" || r.Form.Get("subject_token_type") != accessTokenType {
+		WriteOauthErrorResponse(w, "invalid_request", "An access token subject_token is required")
+		return
+	}
+	if t := r.Form.Get("requested_token_type"); t != "" && t != accessTokenType {
+		WriteOauthErrorResponse(w, "invalid_request", "Only access tokens can be requested")
+		return
+	}
+	// The target is named with audience; resource indicators are not supported here
+	if len(r.Form["audience"]) > 1 || len(r.Form["resource"]) > 0 {
+		WriteOauthErrorResponse(w, "invalid_target", "Name a single audience and no resource")
+		return
+	}
+
+	subject, err := utils.ParseAccessToken(subjectToken)
+	if err != nil {
+		WriteOauthErrorResponse(w, "invalid_grant", "Invalid subject_token")
+		return
+	}
+	username, _ := subject["username"].(string)
+	subjectClient, _ := subject["client_id"].(string)
+	if username == "" || subjectClient == "system" {
+		WriteOauthErrorResponse(w, "invalid_grant", "The subject_token does not belong to a user")
+		return
+	}
+	// Only a client the token was issued to or addressed to may exchange it
+	subjectAud, _ := subject.GetAudience()
+	if subjectClient != clientID && !slices.Contains(subjectAud, clientID) {
+		WriteOauthErrorResponse(w, "invalid_grant", "The subject_token was not issued to or for this client")
+		return
+	}
+	if !subjectKeyPresented(r, subject) {
+		WriteOauthErrorResponse(w, "invalid_grant", "The subject_token is bound to a key this request does not present")
+		return
+	}
+
+	audience := r.Form.Get("audience")
+	if audience == "" {
+		audience = clientID
+	}
+	target, err := db.GetApplication(audience)
+	if err != nil || audience == "system" || appSuspended(target) {
+		WriteOauthErrorResponse(w, "invalid_target", "Unknown or unavailable audience")
+		return
+	}
+	allowed, err := db.CanExchangeToken(clientID, audience)
+	if err != nil {
+		log.Println("Error checking token exchange rules:", err)
+		WriteOauthErrorResponse(w, "server_error", "Failed to process request")
+		return
+	}
+	if !allowed {
+		WriteOauthErrorResponse(w, "invalid_target", "The audience does not accept tokens exchanged by this client")
+		return
+	}
+
+	// Scopes can only be narrowed
+	subjectScope, _ := subject["scope"].(string)
+	scope := subjectScope
+	if requested := strings.Fields(r.Form.Get("scope")); len(requested) > 0 {
+		for _, s := range requested {
+			if !utils.HasScope(subjectScope, s) {
+				WriteOauthErrorResponse(w, "invalid_scope", "The scope exceeds that of the subject_token")
+				return
+			}
+		}
+		scope = strings.Join(requested, " ")
+	}
+
+	act := map[string]interface{}{"sub": clientID, "client_id": clientID}
+	if actorToken := r.Form.Get("actor_token"); actorToken != "" {
+		if r.Form.Get("actor_token_type") != accessTokenType {
+			WriteOauthErrorResponse(w, "invalid_request", "An access token actor_token is required")
+			return
+		}
+		// The actor token must have been issued to the client making the request
+		actor, err := utils.ParseAccessToken(actorToken)
+		if err != nil {
+			WriteOauthErrorResponse(w, "invalid_grant", "Invalid actor_token")
+			return
+		}
+		actorClient, _ := actor["client_id"].(string)
+		actorSub, _ := actor["sub"].(string)
+		if actorClient != clientID || actorSub == "" {
+			WriteOauthErrorResponse(w, "invalid_grant", "The actor_token was not issued to this client")
+			return
+		}
+		act["sub"] = actorSub
+	} else if r.Form.Get("actor_token_type") != "" {
+		WriteOauthErrorResponse(w, "invalid_request", "actor_token_type was sent without actor_token")
+		return
+	}
+	// Keep the delegation chain of a token that was itself exchanged
+	if prior, ok := subject["act"].(map[string]interface{}); ok {
+		act["act"] = prior
+	}
+
+	// Never outlive the subject token
+	lifetime := seconds(target.Policy.AccessTokenLifetime)
+	if exp, err := subject.GetExpirationTime(); err == nil && exp != nil && time.Until(exp.Time) < lifetime {
+		lifetime = time.Until(exp.Time).Truncate(time.Second)
+	}
+	if lifetime <= 0 {
+		WriteOauthErrorResponse(w, "invalid_grant", "The subject_token has expired")
+		return
+	}
+
+	jkt := dpopKey(r)
+	sid, _ := subject["sid"].(string)
+	accessToken, err := utils.GenerateExchangedAccessToken(audience, clientID, username, scope, sid, lifetime, act, confirmation(clientCertThumbprint(r, app), jkt))
+	if err != nil {
+		WriteOauthErrorResponse(w, "server_error", "Failed to generate token")
+		return
+	}
+
+	res := map[string]interface{}{
+		"access_token":      accessToken,
+		"issued_token_type": accessTokenType,
+		"token_type":        tokenType(jkt),
+		"expires_in":        int(lifetime.Seconds()),
+	}
+	if scope != "" {
+		res["scope"] = scope
+	}
+	WriteOauthSuccessResponse(w, res)
+}
+
+// subjectKeyPresented reports whether the request proves possession of the key a bound
+// subject token is confirmed with: the same DPoP key and/or client certificate.
+func subjectKeyPresented(r *http.Request, subject map[string]interface{}) bool {
+	cnf, ok := subject["cnf"].(map[string]interface{})
+	if !ok {
+		return true
+	}
+	if jkt, _ := cnf["jkt"].(string); jkt != "" && jkt != dpopKey(r) {
+		return false
+	}
+	if thumbprint, _ := cnf["x5t#S256"].(string); thumbprint != "" {
+		certs := utils.ClientCertificates(r)
+		if len(certs) == 0 || utils.CertThumbprint(certs[0]) != thumbprint {
+			return false
+		}
+	}
+	return true
+}
+
+// appSuspended reports whether the app is currently suspended.
+func appSuspended(app *types.Application) bool {
+	if app.SuspendUntil == nil {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, *app.SuspendUntil)
+	return err == nil && t.After(time.Now())
+}
+
+// GetTokenExchangeRulesHandler lists the clients allowed to exchange tokens for the app.
+func GetTokenExchangeRulesHandler(w http.ResponseWriter, r *http.Request) {
+	appID := r.URL.Query().Get("id")
+	if appID == "" {
+		WriteErrorResponse(w, http.StatusBadRequest, "App ID is required")
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	isAdmin, err := db.IsAppAdmin(claims.Username, appID)
+	if err != nil || !isAdmin {
+		WriteErrorResponse(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	rules, err := db.ListTokenExchangeRules(appID)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Could not fetch token exchange rules")
+		return
+	}
+
+	WriteSuccessResponse(w, "Token exchange rules", rules)
+}
+
+// AddTokenExchangeRuleHandler lets another app exchange user tokens for tokens addressed to
+// this app. Only the admins of the audience app can grant this.
+func AddTokenExchangeRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.TokenExchangeRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	isAdmin, err := db.IsAppAdmin(claims.Username, req.AppID)
+	if err != nil || !isAdmin {
+		WriteErrorResponse(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	if req.AppID == "system" || req.ClientID == "system" {
+		WriteErrorResponse(w, http.StatusBadRequest, "The system app cannot take part in token exchange")
+		return
+	}
+	if _, err := db.GetApplication(req.ClientID); err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Unknown client app")
+		return
+	}
+
+	if err := db.AddTokenExchangeRule(req.ClientID, req.AppID, claims.Username); err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Could not add token exchange rule")
+		return
+	}
+
+	WriteSuccessResponse(w, "Token exchange rule added", nil)
+}
+
+func RemoveTokenExchangeRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.TokenExchangeRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	isAdmin, err := db.IsAppAdmin(claims.Username, req.AppID)
+	if err != nil || !isAdmin {
+		WriteErrorResponse(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	if err := db.RemoveTokenExchangeRule(req.ClientID, req.AppID); err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Could not remove token exchange rule")
+		return
+	}
+
+	WriteSuccessResponse(w, "Token exchange rule removed", nil)
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"mirpass-backend/config"
 	"mirpass-backend/db"
 	"mirpass-backend/types"
@@ -41,7 +42,7 @@ func MyInfoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var res interface{}
-	if appId == "system" {
+	if appId == "system" || HasScopeInContext(r.Context(), "email") {
 		res = types.UserProfile{
 			Username:  user.Username,
 			Email:     user.Email,
@@ -144,6 +145,8 @@ func AppPublicInfoHandler(w http.ResponseWriter, r *http.Request) {
 
 type VerifyTokenRequest struct {
 	Token string `json:"token"`
+	// Resource is the identifier of the API the token was presented to, if any
+	Resource string `json:"resource"`
 }
 
 type VerifyTokenResponse struct {
@@ -168,11 +171,21 @@ func VerifyTokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims, err := utils.ValidateToken(req.Token)
+	claims, err := utils.ValidateTokenForResource(req.Token, req.Resource)
+	if errors.Is(err, utils.ErrWrongAudience) {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Token is not valid for this resource")
+		return
+	}
 	if err != nil {
 		WriteErrorResponse(w, http.StatusUnauthorized, "Invalid or expired token")
 		return
 	}
+	// Callers of this endpoint do not check the proof of possession a bound token needs,
+	// so it would be accepted from whoever holds it; introspection returns the cnf claim
+	if claims.DPoPJKT != "" || claims.CertThumbprint != "" {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Sender-constrained tokens must be verified through introspection")
+		return
+	}
 
 	resp := VerifyTokenResponse{
 		AppID:    claims.AppID,
@@ -185,13 +198,13 @@ func VerifyTokenHandler(w http.ResponseWriter, r *http.Request) {
 func UserInfoHandler(w http.ResponseWriter, r *http.Request) {
 	username := GetUsernameFromContext(r.Context())
 	if username == "" {
-		WriteOauthErrorResponse(w, "access_denied") // OIDC error format
+		WriteOauthErrorResponse(w, "access_denied", "No user is associated with the token") // OIDC error format
 		return
 	}
 
 	user, err := db.GetUserByUsername(username)
 	if err != nil {
-		WriteOauthErrorResponse(w, "invalid_request")
+		WriteOauthErrorResponse(w, "invalid_request", "User not found")
 		return
 	}
 
@@ -201,11 +214,15 @@ func UserInfoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	claims := map[string]interface{}{
-		"sub":                user.Username,
-		"nickname":           name,
-		"preferred_username": user.Username,
-		"email":              user.Email,
-		"avatar_url":         FormatUrl(user.AvatarURL),
+		"sub": user.Username,
+	}
+	if HasScopeInContext(r.Context(), "profile") {
+		claims["nickname"] = name
+		claims["preferred_username"] = user.Username
+		claims["avatar_url"] = FormatUrl(user.AvatarURL)
+	}
+	if HasScopeInContext(r.Context(), "email") {
+		claims["email"] = user.Email
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"mirpass-backend/config"
+	"mirpass-backend/db"
+	"mirpass-backend/utils"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// requestObjectClaims are JWT claims of a request object that are not authorization parameters.
+var requestObjectClaims = []string{"iss", "aud", "exp", "iat", "nbf", "jti"}
+
+// unpackRequestObject verifies a signed request object (RFC 9101) sent in the request
+// parameter and returns its claims as the authorization parameters. Without a request
+// parameter q is returned unchanged and signed is false. Errors are never redirected, since
+// the redirect_uri inside an unverified object cannot be trusted.
+func unpackRequestObject(q url.Values) (params url.Values, signed bool, aerr *authorizeError) {
+	raw := q.Get("request")
+	if raw == "" {
+		return q, false, nil
+	}
+
+	invalid := func(msg string) (url.Values, bool, *authorizeError) {
+		return nil, false, &authorizeError{code: "invalid_request_object", description: msg}
+	}
+
+	clientID := q.Get("client_id")
+	if clientID == "" {
+		return invalid("missing client_id")
+	}
+	app, err := db.GetApplication(clientID)
+	if err != nil {
+		return invalid("invalid client_id")
+	}
+	if app.JWKS == "" {
+		return invalid("the app has no registered keys for request objects")
+	}
+
+	claims, err := utils.VerifyClientJWT(raw, app.JWKS,
+		jwt.WithIssuer(clientID),
+		jwt.WithAudience(strings.TrimSuffix(config.AppConfig.BackendURL, "/")),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return invalid("invalid request object: " + err.Error())
+	}
+	if id, ok := claims["client_id"]; ok && id != clientID {
+		return invalid("client_id in the request object does not match")
+	}
+	if _, ok := claims["request"]; ok {
+		return invalid("request objects cannot be nested")
+	}
+	if _, ok := claims["request_uri"]; ok {
+		return invalid("request objects cannot be nested")
+	}
+
+	params = url.Values{}
+	for k, v := range claims {
+		if k == "client_id" || slices.Contains(requestObjectClaims, k) {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			params.Set(k, v)
+		case float64:
+			params.Set(k, strconv.FormatFloat(v, 'f', -1, 64))
+		case []interface{}:
+			// Multi-valued parameters such as resource
+			for _, item := range v {
+				if item, ok := item.(string); ok {
+					params.Add(k, item)
+				}
+			}
+		}
+	}
+	params.Set("client_id", clientID)
+	return params, true, nil
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"mirpass-backend/config"
+	"mirpass-backend/db"
+	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const logoutRequestLifetime = 10 * time.Minute
+
+// EndSessionHandler implements OIDC RP-initiated logout. The request is validated here and
+// stored; the frontend then ends the MirPass session, since only it holds the session token.
+func EndSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeErrorPage(w, "invalid_request", "The logout request could not be read")
+		return
+	}
+
+	clientID := r.Form.Get("client_id")
+	redirectURI := r.Form.Get("post_logout_redirect_uri")
+
+	var username string
+	if hint := r.Form.Get("id_token_hint"); hint != "" {
+		claims, err := utils.ParseIDTokenHint(hint)
+		if err != nil {
+			writeErrorPage(w, "invalid_request", "The id_token_hint is invalid")
+			return
+		}
+		aud, _ := claims["aud"].(string)
+		if clientID != "" && clientID != aud {
+			writeErrorPage(w, "invalid_request", "client_id does not match the id_token_hint")
+			return
+		}
+		clientID = aud
+		username, _ = claims["sub"].(string)
+	}
+
+	if clientID != "" {
+		if _, err := db.GetApplication(clientID); err != nil {
+			writeErrorPage(w, "invalid_client", "Unknown client_id")
+			return
+		}
+	}
+
+	if redirectURI != "" {
+		// Without a known client there is nothing to validate the redirect against
+		if clientID == "" {
+			writeErrorPage(w, "invalid_request", "post_logout_redirect_uri requires id_token_hint or client_id")
+			return
+		}
+		trusted, err := db.IsTrustedURI(clientID, redirectURI)
+		if err != nil {
+			log.Print("Failed to validate trusted URI:", err)
+			writeErrorPage(w, "server_error", "Something went wrong, please try again")
+			return
+		}
+		if !trusted {
+			writeErrorPage(w, "invalid_request", "post_logout_redirect_uri is not registered for this application")
+			return
+		}
+	}
+
+	req := types.LogoutRequest{
+		LogoutID:    utils.GenerateToken(),
+		ClientID:    clientID,
+		Username:    username,
+		RedirectURI: redirectURI,
+		State:       r.Form.Get("state"),
+	}
+	if err := db.CreateLogoutRequest(&req, time.Now().Add(logoutRequestLifetime)); err != nil {
+		log.Println("Error creating logout request:", err)
+		writeErrorPage(w, "server_error", "Something went wrong, please try again")
+		return
+	}
+
+	http.Redirect(w, r, config.AppConfig.FrontendURL+"/logout?logout_id="+url.QueryEscape(req.LogoutID), http.StatusFound)
+}
+
+// LogoutRequestDetailsHandler tells the frontend which app asked for the logout.
+func LogoutRequestDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := db.GetLogoutRequest(r.URL.Query().Get("logout_id"))
+	if err != nil {
+		WriteErrorResponse(w, 400, "Invalid or expired logout request")
+		return
+	}
+
+	res := map[string]interface{}{
+		"username": req.Username,
+	}
+	if req.ClientID != "" {
+		if app, err := db.GetApplication(req.ClientID); err == nil {
+			res["appId"] = app.ID
+			res["appName"] = app.Name
+		}
+	}
+	WriteSuccessResponse(w, "Logout request details", res)
+}
+
+// LogoutConfirmHandler completes an RP-initiated logout. The session token is optional:
+// a browser that is already signed out still gets sent back to the app.
+func LogoutConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteErrorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var body struct {
+		LogoutID string `json:"logoutId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		WriteErrorResponse(w, 400, "Invalid request")
+		return
+	}
+
+	req, err := db.GetLogoutRequest(body.LogoutID)
+	if err != nil {
+		WriteErrorResponse(w, 400, "Invalid or expired logout request")
+		return
+	}
+	if ok, err := db.CompleteLogoutRequest(req.LogoutID); err != nil || !ok {
+		WriteErrorResponse(w, 400, "Invalid or expired logout request")
+		return
+	}
+
+	if username := endSystemSession(r); username != "" {
+		endUserSessions(username, "logout", false)
+	}
+
+	redirect := ""
+	if req.RedirectURI != "" {
+		redirect = withQueryParam(req.RedirectURI, "state", req.State)
+	}
+	WriteSuccessResponse(w, "Logged out", map[string]string{"redirectUri": redirect})
+}
+
+// LogoutHandler ends the caller's dashboard session.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteErrorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if username := endSystemSession(r); username != "" {
+		endUserSessions(username, "logout", false)
+	}
+	WriteSuccessResponse(w, "Logged out", nil)
+}
+
+// endSystemSession revokes the dashboard token on the request, if there is one, so it
+// stops working before its natural expiry. It returns the signed-out user, or "".
+func endSystemSession(r *http.Request) string {
+	claims, err := utils.ExtractClaims(r)
+	if err != nil || claims.JTI == "" {
+		return ""
+	}
+	if err := db.RevokeToken(claims.JTI, "system", claims.ExpiresAt); err != nil {
+		log.Println("Error revoking session token:", err)
+		return ""
+	}
+	return claims.Username
+}
+
+// withQueryParam appends a query parameter, keeping any query the URI already has.
+func withQueryParam(rawURI, key, value string) string {
+	if value == "" {
+		return rawURI
+	}
+	u, err := url.Parse(rawURI)
+	if err != nil {
+		return rawURI
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -11,6 +11,7 @@ import (
 type contextKey string
 
 const UsernameKey contextKey = "username"
+const ScopeKey contextKey = "scope"
 
 func CORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -24,7 +25,8 @@ func CORSMiddleware(next http.Handler) http.Handler {
 		}
 
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Requested-With, X-Api-Key")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Requested-With, X-Api-Key, DPoP")
+		w.Header().Set("Access-Control-Expose-Headers", "DPoP-Nonce, WWW-Authenticate")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		// Handle preflight requests
@@ -75,7 +77,7 @@ func AuthMiddleware(next http.Handler) http.Handler {
 		}
 
 		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
+		if len(parts) != 2 || (parts[0] != "Bearer" && parts[0] != "DPoP") {
 			WriteErrorResponse(w, http.StatusUnauthorized, "Authorization header must be in format Bearer {token}")
 			return
 		}
@@ -86,16 +88,47 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			WriteErrorResponse(w, http.StatusUnauthorized, "Invalid or expired token")
 			return
 		}
+		// DPoP-bound tokens need the DPoP scheme and a proof from the same key (RFC 9449)
+		if (claim.DPoPJKT != "") != (parts[0] == "DPoP") {
+			writeDPoPChallenge(w, "invalid_token", "Token type does not match the authorization scheme")
+			return
+		}
+		if claim.DPoPJKT != "" {
+			w.Header().Set("DPoP-Nonce", utils.DPoPNonce())
+			jkt, code := checkDPoPProof(r, tokenString)
+			if code == "" && jkt != claim.DPoPJKT {
+				code = "invalid_dpop_proof"
+			}
+			if code != "" {
+				writeDPoPChallenge(w, code, "Invalid DPoP proof")
+				return
+			}
+		}
+		// Certificate-bound tokens are only accepted with the same client certificate (RFC 8705)
+		if claim.CertThumbprint != "" {
+			certs := utils.ClientCertificates(r)
+			if len(certs) == 0 || utils.CertThumbprint(certs[0]) != claim.CertThumbprint {
+				WriteErrorResponse(w, http.StatusUnauthorized, "Token is bound to a different client certificate")
+				return
+			}
+		}
 
 		// Add username to request context
 		ctx := context.WithValue(r.Context(), UsernameKey, claim.Username)
 		ctx = context.WithValue(ctx, "appId", claim.AppID)
+		ctx = context.WithValue(ctx, ScopeKey, claim.Scope)
 		r = r.WithContext(ctx)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// writeDPoPChallenge rejects a resource request with a DPoP WWW-Authenticate challenge.
+func writeDPoPChallenge(w http.ResponseWriter, code string, message string) {
+	w.Header().Set("WWW-Authenticate", `DPoP error="`+code+`", algs="`+strings.Join(utils.ClientSigningAlgs, " ")+`"`)
+	WriteErrorResponse(w, http.StatusUnauthorized, message)
+}
+
 func GetUsernameFromContext(ctx context.Context) string {
 	username, ok := ctx.Value(UsernameKey).(string)
 	if !ok {
@@ -104,6 +137,16 @@ func GetUsernameFromContext(ctx context.Context) string {
 	return username
 }
 
+// HasScopeInContext reports whether the token behind the request was granted the scope.
+// System tokens belong to the MirPass dashboard itself and are not scope-limited.
+func HasScopeInContext(ctx context.Context, want string) bool {
+	if appId, _ := ctx.Value("appId").(string); appId == "system" {
+		return true
+	}
+	scope, _ := ctx.Value(ScopeKey).(string)
+	return utils.HasScope(scope, want)
+}
+
 func RequireAdmin(app string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		username := GetUsernameFromContext(r.Context())
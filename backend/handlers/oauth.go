@@ -2,66 +2,132 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"mirpass-backend/config"
 	"mirpass-backend/db"
 	"mirpass-backend/types"
 	"mirpass-backend/utils"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+const tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+// supportedGrantTypes lists every grant the token endpoint implements. Apps may narrow it via their policy.
+var supportedGrantTypes = []string{"authorization_code", "refresh_token", "client_credentials", deviceCodeGrantType, tokenExchangeGrantType}
+
+func grantAllowed(app *types.Application, grantType string) bool {
+	return slices.Contains(app.Policy.AllowedGrantTypes, grantType)
+}
+
+// oauth21Strict reports whether the OAuth 2.1 rules apply to the app: its own setting,
+// or the server's when it has none.
+func oauth21Strict(app *types.Application) bool {
+	if app.Policy.OAuth21Strict != nil {
+		return *app.Policy.OAuth21Strict
+	}
+	return config.AppConfig.OAuth21Strict
+}
+
+var supportedPromptValues = []string{"none", "login", "consent", "select_account"}
+
+// parsePrompt validates the space-delimited OIDC prompt parameter. "none" cannot be combined with other values.
+func parsePrompt(raw string) (string, error) {
+	values := strings.Fields(raw)
+	for _, v := range values {
+		if !slices.Contains(supportedPromptValues, v) {
+			return "", fmt.Errorf("unsupported prompt value %q", v)
+		}
+	}
+	if len(values) > 1 && slices.Contains(values, "none") {
+		return "", errors.New("prompt=none cannot be combined with other values")
+	}
+	return strings.Join(values, " "), nil
+}
+
+// loginTooOld reports whether a sign-in at authTime is too old for the request: prompt=login
+// needs a sign-in made after the request was created, max_age bounds its age in seconds.
+func loginTooOld(prompt string, maxAge *int, createdAt string, authTime time.Time) bool {
+	if slices.Contains(strings.Fields(prompt), "login") {
+		created, err := time.Parse(time.RFC3339, createdAt)
+		if err != nil || authTime.Before(created) {
+			return true
+		}
+	}
+	return maxAge != nil && time.Since(authTime) > time.Duration(*maxAge)*time.Second
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
 func WriteOauthSuccessResponse(w http.ResponseWriter, res interface{}) {
 	w.Header().Set("Content-Type", "application/json")
+	noStore(w)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(res)
 }
 
-func WriteOauthErrorResponse(w http.ResponseWriter, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(400)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
-}
-
 func DeviceFlowInitiateHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		WriteErrorResponse(w, 400, "Invalid request")
+		WriteOauthErrorResponse(w, "invalid_request", "Malformed request body")
 		return
 	}
 	clientID := r.Form.Get("client_id")
 
 	if clientID == "" {
-		WriteErrorResponse(w, 400, "client_id is required")
+		WriteOauthErrorResponse(w, "invalid_request", "client_id is required")
 		return
 	}
 
 	app, err := db.GetApplication(clientID)
 	if err != nil {
-		WriteErrorResponse(w, 400, "Invalid client_id")
+		WriteOauthErrorResponse(w, "invalid_client", "Unknown client_id")
 		return
 	}
 
 	if app.SuspendUntil != nil {
 		t, err := time.Parse(time.RFC3339, *app.SuspendUntil)
 		if err == nil && t.After(time.Now()) {
-			WriteErrorResponse(w, 400, "Application is suspended")
+			WriteOauthErrorResponse(w, "unauthorized_client", "The application is suspended")
 			return
 		}
 	}
 
 	if !app.DeviceCodeEnabled {
-		WriteErrorResponse(w, 400, "Device code flow is disabled for this application")
+		WriteOauthErrorResponse(w, "unauthorized_client", "The device code flow is disabled for this application")
+		return
+	}
+	if !grantAllowed(app, deviceCodeGrantType) {
+		WriteOauthErrorResponse(w, "unauthorized_client", "The device code grant is not allowed for this application")
+		return
+	}
+
+	scope, err := utils.NormalizeScope(r.Form.Get("scope"))
+	if err != nil {
+		WriteOauthErrorResponse(w, "invalid_scope", err.Error())
 		return
 	}
 
 	sessionId := utils.GenerateToken()
 	deviceCode := utils.GenerateToken()
-	userCode := utils.GenerateUserCode()
+	userCode, err := newUserCode(app.Policy)
+	if err != nil {
+		log.Println("Error generating user code:", err)
+		WriteOauthErrorResponse(w, "server_error", "Failed to create device flow")
+		return
+	}
 
-	err = db.CreateDeviceFlowSession(app.ID, sessionId, deviceCode, userCode)
+	err = db.CreateDeviceFlowSession(app.ID, sessionId, deviceCode, userCode, scope, utils.ClientIP(r), r.UserAgent(), time.Now().Add(seconds(app.Policy.DeviceCodeLifetime)))
 	if err != nil {
-		WriteErrorResponse(w, http.StatusInternalServerError, "Failed to create device flow")
+		WriteOauthErrorResponse(w, "server_error", "Failed to create device flow")
 		return
 	}
 
@@ -70,138 +136,248 @@ func DeviceFlowInitiateHandler(w http.ResponseWriter, r *http.Request) {
 		"user_code":                 userCode,
 		"verification_uri":          config.AppConfig.FrontendURL + "/auth",
 		"verification_uri_complete": config.AppConfig.FrontendURL + "/auth?user_code=" + userCode,
-		"interval":                  5,   // 5 seconds
-		"expires_in":                900, // 15 minutes
+		"interval":                  app.Policy.DevicePollInterval,
+		"expires_in":                app.Policy.DeviceCodeLifetime,
 	}
 	WriteOauthSuccessResponse(w, resp)
 }
 
+// newUserCode generates a user code in the app's format that no pending session is using.
+// Short numeric codes can collide, so a few fresh codes are tried.
+func newUserCode(p types.AppPolicy) (string, error) {
+	for range 5 {
+		code := utils.GenerateUserCode(p.UserCodeAlphabet, p.UserCodeLength)
+		inUse, err := db.UserCodeInUse(code)
+		if err != nil {
+			return "", err
+		}
+		if !inUse {
+			return code, nil
+		}
+	}
+	return "", errors.New("no free user code")
+}
+
 func GetTokenHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		log.Print("GetTokenHandler - ParseForm:", err)
-		WriteErrorResponse(w, 400, "Invalid request")
+		WriteOauthErrorResponse(w, "invalid_request", "Malformed request body")
 		return
 	}
 
 	grantType := r.Form.Get("grant_type")
 	if grantType == "" {
-		WriteErrorResponse(w, 400, "Missing grant_type")
+		WriteOauthErrorResponse(w, "invalid_request", "grant_type is required")
 		return
 	}
 
+	// A DPoP proof binds the issued tokens to the client's key (RFC 9449)
+	if len(r.Header.Values("DPoP")) > 0 {
+		w.Header().Set("DPoP-Nonce", utils.DPoPNonce())
+		jkt, code := checkDPoPProof(r, "")
+		if code != "" {
+			WriteOauthErrorResponse(w, code, "Invalid DPoP proof")
+			return
+		}
+		r = withDPoPKey(r, jkt)
+	}
+
 	switch grantType {
-	case "urn:ietf:params:oauth:grant-type:device_code":
+	case deviceCodeGrantType:
 		DeviceFlowPollHandler(w, r)
 	case "authorization_code":
 		AuthCodeFlowTokenHandler(w, r)
+	case "refresh_token":
+		RefreshTokenGrantHandler(w, r)
+	case "client_credentials":
+		ClientCredentialsGrantHandler(w, r)
+	case tokenExchangeGrantType:
+		TokenExchangeGrantHandler(w, r)
 	default:
-		WriteErrorResponse(w, 400, "Unsupported grant_type")
+		WriteOauthErrorResponse(w, "unsupported_grant_type", "Unsupported grant_type")
 	}
 }
 
 func DeviceFlowPollHandler(w http.ResponseWriter, r *http.Request) {
-	clientID := r.Form.Get("client_id")
 	deviceCode := r.Form.Get("device_code")
 
 	if deviceCode == "" {
-		WriteErrorResponse(w, 400, "Invalid request: missing device_code")
+		WriteOauthErrorResponse(w, "invalid_request", "device_code is required")
+		return
+	}
+
+	// Public clients only send client_id; confidential ones must authenticate as for any grant
+	clientID, confidential, err := authenticateClient(r)
+	if err != nil {
+		WriteOauthErrorResponse(w, "invalid_client", "Client authentication failed")
 		return
 	}
 
 	session, err := db.GetSessionByDeviceCode(deviceCode)
 	if err != nil || session.Status == "consumed" {
 		log.Println("Error fetching session for device code:", err)
-		WriteErrorResponse(w, 400, "Invalid device_code")
+		WriteOauthErrorResponse(w, "invalid_grant", "Invalid or already used device_code")
 		return
 	}
 
-	// Validate client_id if provided
-	if clientID != "" && session.ClientID != clientID {
-		WriteErrorResponse(w, 400, "client_id mismatch")
+	if session.ClientID != clientID {
+		WriteOauthErrorResponse(w, "invalid_grant", "The device_code was issued to another client")
+		return
+	}
+
+	app, err := db.GetApplication(session.ClientID)
+	if err != nil {
+		WriteOauthErrorResponse(w, "invalid_client", "Unknown client")
+		return
+	}
+	if !grantAllowed(app, deviceCodeGrantType) {
+		WriteOauthErrorResponse(w, "unauthorized_client", "The device code grant is not allowed for this application")
 		return
 	}
 
-	if t, err := time.Parse(time.RFC3339, session.LastPoll); err == nil && time.Since(t) < 5*time.Second {
-		WriteOauthErrorResponse(w, "slow_down")
+	// Each slow_down adds 5 seconds to the interval the device must keep (RFC 8628 section 3.5)
+	interval := max(session.PollInterval, app.Policy.DevicePollInterval)
+	if t, err := time.Parse(time.RFC3339, session.LastPoll); err == nil && time.Since(t) < seconds(interval) {
+		db.SlowDownSession(session.SessionID, interval+5)
+		WriteOauthErrorResponse(w, "slow_down", "Polling too often")
 		return
 	}
 	db.UpdateSessionPoll(session.SessionID)
 
 	if session.Status == "pending" {
-		WriteOauthErrorResponse(w, "authorization_pending")
+		WriteOauthErrorResponse(w, "authorization_pending", "The user has not finished authorizing yet")
 		return
 	}
 	if session.Status == "denied" {
-		WriteOauthErrorResponse(w, "access_denied")
+		WriteOauthErrorResponse(w, "access_denied", "The user denied the request")
 		return
 	}
 	if session.Status == "expired" {
-		WriteOauthErrorResponse(w, "expired_token")
+		WriteOauthErrorResponse(w, "expired_token", "The device_code has expired")
 		return
 	}
 	if session.Status == "authorized" {
 		if session.Username == "" {
-			WriteErrorResponse(w, 500, "Invalid authorized session: missing username")
+			WriteOauthErrorResponse(w, "server_error", "Authorized session has no user")
 			return
 		}
 
-		accessToken, err := utils.GenerateJWTToken(session.ClientID, session.Username, time.Hour*24*7) // TODO: let app set token expiry
+		// Device authorization requests carry no resource indicators
+		if len(r.Form["resource"]) > 0 {
+			WriteOauthErrorResponse(w, "invalid_target", "Device authorization does not support resource indicators")
+			return
+		}
+
+		// Claim the session before issuing, so concurrent polls cannot both get tokens
+		consumed, err := db.ConsumeAuthorizedSession(session.SessionID)
 		if err != nil {
-			WriteErrorResponse(w, 500, "Failed to generate access token")
+			log.Println("Error consuming device code:", err)
+			WriteOauthErrorResponse(w, "server_error", "Failed to process request")
+			return
+		}
+		if !consumed {
+			WriteOauthErrorResponse(w, "invalid_grant", "Invalid or already used device_code")
 			return
 		}
 
-		idToken, err := utils.GenerateIDToken(session.ClientID, session.Username, "")
+		res, err := issueTokens(tokenGrant{
+			ClientID:  session.ClientID,
+			Username:  session.Username,
+			Scope:     session.Scope,
+			AuthTime:  session.AuthTime,
+			SessionID: session.SessionID,
+			Policy:    app.Policy,
+			DPoPJKT:   dpopKey(r),
+		})
 		if err != nil {
-			WriteErrorResponse(w, 500, "Failed to generate ID token")
+			WriteOauthErrorResponse(w, "server_error", "Failed to generate tokens")
 			return
 		}
 
-		res := map[string]interface{}{
-			"token_type":   "Bearer",
-			"access_token": accessToken,
-			"id_token":     idToken,
-			"expires_in":   604800, // 7 days in seconds
+		refreshToken, err := issueRefreshToken(session.SessionID, session.ClientID, session.Username, confidential, dpopKey(r), app.Policy)
+		if err != nil {
+			log.Println("Error creating refresh token:", err)
+			WriteOauthErrorResponse(w, "server_error", "Failed to generate refresh token")
+			return
 		}
-		db.UpdateSessionStatus(session.SessionID, "consumed", "")
+		res["refresh_token"] = refreshToken
+
 		db.AddHistory(session.Username, session.ClientID)
 		WriteOauthSuccessResponse(w, res)
 		return
 	}
-	WriteErrorResponse(w, 500, "Failed to process request")
+	WriteOauthErrorResponse(w, "server_error", "Failed to process request")
 }
 
 func AuthCodeFlowTokenHandler(w http.ResponseWriter, r *http.Request) {
 	code := r.Form.Get("code")
-	clientID := r.Form.Get("client_id")
-	clientSecret := r.Form.Get("client_secret")
 	codeVerifier := r.Form.Get("code_verifier")
 
-	// Allow client_id to be missing from body if available in Basic Auth
-	username, _, ok := r.BasicAuth()
-	if clientID == "" && ok {
-		clientID = username
+	if code == "" {
+		WriteOauthErrorResponse(w, "invalid_request", "code is required")
+		return
 	}
 
-	if code == "" || clientID == "" {
-		WriteErrorResponse(w, 400, "Invalid request: missing code or client_id")
+	// Public clients only send client_id and prove themselves with PKCE below
+	clientID, confidential, err := authenticateClient(r)
+	if err != nil {
+		WriteOauthErrorResponse(w, "invalid_client", "Client authentication failed")
 		return
 	}
 
 	session, err := db.GetAuthCodeSessionByCode(code)
+	if err == nil && session.Status == "consumed" {
+		// A replayed code may have been stolen, so nothing issued from it can be trusted
+		revokeReplayedCode(session)
+	}
 	if err != nil || session.Status != "authorized" {
-		WriteErrorResponse(w, 400, "Invalid code")
+		WriteOauthErrorResponse(w, "invalid_grant", "Invalid, expired or already used code")
 		return
 	}
 
 	if session.ClientID != clientID {
-		WriteErrorResponse(w, 400, "client_id does not match")
+		WriteOauthErrorResponse(w, "invalid_grant", "The code was issued to another client")
+		return
+	}
+
+	app, err := db.GetApplication(clientID)
+	if err != nil {
+		WriteOauthErrorResponse(w, "invalid_client", "Unknown client")
+		return
+	}
+	if !grantAllowed(app, "authorization_code") {
+		WriteOauthErrorResponse(w, "unauthorized_client", "The authorization code grant is not allowed for this application")
+		return
+	}
+	// The policy may have been tightened after the code was issued
+	if session.CodeChallenge == "" && app.Policy.RequirePKCE {
+		WriteOauthErrorResponse(w, "invalid_grant", "PKCE is required for this application")
+		return
+	}
+	if session.CodeChallenge != "" && session.CodeChallengeMethod == "plain" && !app.Policy.AllowPlainPKCE {
+		WriteOauthErrorResponse(w, "invalid_grant", "The plain code_challenge_method is not allowed for this application")
+		return
+	}
+	strict := oauth21Strict(app)
+	if strict && (session.CodeChallenge == "" || session.CodeChallengeMethod != "S256") {
+		WriteOauthErrorResponse(w, "invalid_grant", "PKCE with S256 is required for this application")
+		return
+	}
+	// The redirect_uri must be repeated exactly; OAuth 2.1 makes it mandatory
+	redirectURI := r.Form.Get("redirect_uri")
+	if (strict && redirectURI == "") || (redirectURI != "" && redirectURI != session.RedirectURI) {
+		WriteOauthErrorResponse(w, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	}
+
+	if !confidential && session.CodeChallenge == "" {
+		WriteOauthErrorResponse(w, "invalid_client", "Client authentication is required when not using PKCE")
 		return
 	}
 
 	if session.CodeChallenge != "" {
 		if codeVerifier == "" {
-			WriteErrorResponse(w, 400, "code_verifier required for this request")
+			WriteOauthErrorResponse(w, "invalid_request", "code_verifier is required for this code")
 			return
 		}
 
@@ -209,86 +385,643 @@ func AuthCodeFlowTokenHandler(w http.ResponseWriter, r *http.Request) {
 		case "S256":
 			hashedVerifier := utils.Sha256(codeVerifier)
 			if hashedVerifier != session.CodeChallenge {
-				WriteErrorResponse(w, 400, "Invalid code_verifier")
+				WriteOauthErrorResponse(w, "invalid_grant", "Invalid code_verifier")
 				return
 			}
 		case "plain":
 			if codeVerifier != session.CodeChallenge {
-				WriteErrorResponse(w, 400, "Invalid code_verifier")
+				WriteOauthErrorResponse(w, "invalid_grant", "Invalid code_verifier")
 				return
 			}
 		default:
-			WriteErrorResponse(w, 500, "Internal Server Error")
+			WriteOauthErrorResponse(w, "server_error", "Unknown code_challenge_method")
 			return
 		}
-	} else {
-		// No PKCE, require client secret
-		// Check for client secret in body (already got it)
-		if clientSecret == "" {
-			// Check for client secret in Basic Auth header
-			_, password, ok := r.BasicAuth()
-			if ok {
-				clientSecret = password
-			}
+	}
+
+	audience, scope, err := tokenAudience(r, session.Resources, session.Scope)
+	if err != nil {
+		writeTokenAudienceError(w, err)
+		return
+	}
+
+	// Claim the code before issuing, so concurrent requests with it cannot both succeed
+	consumed, err := db.ConsumeAuthorizedSession(session.SessionID)
+	if err != nil {
+		log.Println("Error consuming authorization code:", err)
+		WriteOauthErrorResponse(w, "server_error", "Failed to process request")
+		return
+	}
+	if !consumed {
+		WriteOauthErrorResponse(w, "invalid_grant", "Invalid, expired or already used code")
+		return
+	}
+
+	res, err := issueTokens(tokenGrant{
+		ClientID:       session.ClientID,
+		Username:       session.Username,
+		Scope:          scope,
+		Nonce:          session.Nonce,
+		AuthTime:       session.AuthTime,
+		SessionID:      session.SessionID,
+		Policy:         app.Policy,
+		Resources:      audience,
+		CertThumbprint: clientCertThumbprint(r, app),
+		DPoPJKT:        dpopKey(r),
+	})
+	if err != nil {
+		WriteOauthErrorResponse(w, "server_error", "Failed to generate tokens")
+		return
+	}
+
+	refreshToken, err := issueRefreshToken(session.SessionID, session.ClientID, session.Username, confidential, dpopKey(r), app.Policy)
+	if err != nil {
+		log.Println("Error creating refresh token:", err)
+		WriteOauthErrorResponse(w, "server_error", "Failed to generate refresh token")
+		return
+	}
+	res["refresh_token"] = refreshToken
+
+	db.AddHistory(session.Username, session.ClientID)
+	WriteOauthSuccessResponse(w, res)
+}
+
+// revokeReplayedCode revokes every token issued from a code that is being used again
+// (RFC 6749 section 4.1.2).
+func revokeReplayedCode(session *types.AuthCodeFlowSession) {
+	app, err := db.GetApplication(session.ClientID)
+	if err != nil {
+		log.Println("Error loading app for replayed code:", err)
+		return
+	}
+	lifetime := max(app.Policy.AccessTokenLifetime, app.Policy.IDTokenLifetime)
+	if err := db.RevokeSessionTokens(session.SessionID, session.ClientID, time.Now().Add(seconds(lifetime))); err != nil {
+		log.Println("Error revoking tokens of replayed code:", err)
+	}
+}
+
+// tokenGrant describes what a successful grant authorizes; issueTokens turns it into tokens.
+type tokenGrant struct {
+	ClientID  string
+	Username  string
+	Scope     string
+	Nonce     string
+	AuthTime  string
+	SessionID string
+	Policy    types.AppPolicy
+	// Resources are the API identifiers the access token is for; the client itself when empty
+	Resources []string
+	// CertThumbprint and DPoPJKT bind the access token to the client's mTLS certificate
+	// or DPoP key when set
+	CertThumbprint string
+	DPoPJKT        string
+}
+
+// issueTokens builds the token endpoint response shared by every grant type.
+// An ID token is only included when the openid scope was granted.
+func issueTokens(g tokenGrant) (map[string]interface{}, error) {
+	if g.ClientID == "system" {
+		// The dashboard has its own token type; never mint app tokens in its name
+		return nil, errors.New("cannot issue app tokens for the system client")
+	}
+
+	sid := ""
+	if g.SessionID != "" {
+		sid = utils.SessionSID(g.SessionID)
+	}
+	accessToken, err := utils.GenerateAccessToken(g.ClientID, g.Username, g.Scope, sid, g.Resources, seconds(g.Policy.AccessTokenLifetime), confirmation(g.CertThumbprint, g.DPoPJKT))
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]interface{}{
+		"token_type":   tokenType(g.DPoPJKT),
+		"access_token": accessToken,
+		"expires_in":   g.Policy.AccessTokenLifetime,
+		"scope":        g.Scope,
+	}
+
+	if utils.HasScope(g.Scope, "openid") {
+		opts := utils.IDTokenOptions{
+			Nonce:       g.Nonce,
+			AccessToken: accessToken,
+			Lifetime:    seconds(g.Policy.IDTokenLifetime),
+			SessionID:   g.SessionID,
 		}
+		if t, err := time.Parse(time.RFC3339, g.AuthTime); err == nil {
+			opts.AuthTime = t
+		}
+		idToken, err := utils.GenerateIDToken(g.ClientID, g.Username, opts)
+		if err != nil {
+			return nil, err
+		}
+		res["id_token"] = idToken
+	}
+	return res, nil
+}
 
-		if clientSecret == "" {
-			WriteErrorResponse(w, 401, "client_secret is required when not using PKCE")
+// issueRefreshToken starts a new refresh token family for a freshly authorized session.
+// Public clients' refresh tokens are bound to their DPoP key, if they used one; confidential
+// clients are already tied to their credentials and may rotate keys.
+func issueRefreshToken(sessionId, clientId, username string, confidential bool, dpopJKT string, policy types.AppPolicy) (string, error) {
+	if confidential {
+		dpopJKT = ""
+	}
+	token := utils.GenerateRefreshToken()
+	err := db.CreateRefreshToken(utils.GenerateID(), sessionId, clientId, username, utils.Sha256(token), confidential, dpopJKT, time.Now().Add(seconds(policy.RefreshTokenLifetime)))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func RefreshTokenGrantHandler(w http.ResponseWriter, r *http.Request) {
+	refreshToken := r.Form.Get("refresh_token")
+	if refreshToken == "" {
+		WriteOauthErrorResponse(w, "invalid_request", "refresh_token is required")
+		return
+	}
+
+	clientID, authenticated, err := authenticateClient(r)
+	if err != nil {
+		WriteOauthErrorResponse(w, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	stored, err := db.GetRefreshToken(utils.Sha256(refreshToken))
+	if err != nil || stored.ClientID != clientID {
+		WriteOauthErrorResponse(w, "invalid_grant", "Invalid refresh_token")
+		return
+	}
+
+	// Clients that authenticated when the family was issued must keep doing so
+	if stored.Confidential && !authenticated {
+		WriteOauthErrorResponse(w, "invalid_client", "Client authentication is required for this refresh_token")
+		return
+	}
+	// A bound refresh token needs a proof from the same key
+	if stored.DPoPJKT != "" && stored.DPoPJKT != dpopKey(r) {
+		WriteOauthErrorResponse(w, "invalid_dpop_proof", "The refresh_token is bound to another DPoP key")
+		return
+	}
+
+	if stored.Status == "rotated" {
+		// A rotated token showing up again means it leaked; kill every token derived from the grant
+		log.Printf("Refresh token reuse detected for client %s, revoking family %s", stored.ClientID, stored.FamilyID)
+		db.RevokeRefreshTokenFamily(stored.FamilyID)
+		WriteOauthErrorResponse(w, "invalid_grant", "The refresh_token was already used")
+		return
+	}
+	if stored.Status != "active" {
+		WriteOauthErrorResponse(w, "invalid_grant", "The refresh_token has been revoked")
+		return
+	}
+	if t, err := time.Parse(time.RFC3339, stored.ExpiresAt); err != nil || time.Now().After(t) {
+		WriteOauthErrorResponse(w, "invalid_grant", "The refresh_token has expired")
+		return
+	}
+
+	app, err := db.GetApplication(stored.ClientID)
+	if err != nil {
+		WriteOauthErrorResponse(w, "invalid_client", "Unknown client")
+		return
+	}
+	if !grantAllowed(app, "refresh_token") {
+		WriteOauthErrorResponse(w, "unauthorized_client", "The refresh token grant is not allowed for this application")
+		return
+	}
+	if app.SuspendUntil != nil {
+		t, err := time.Parse(time.RFC3339, *app.SuspendUntil)
+		if err == nil && t.After(time.Now()) {
+			WriteOauthErrorResponse(w, "unauthorized_client", "The application is suspended")
 			return
 		}
+	}
 
-		if !db.ValidateAppSecret(clientID, clientSecret) {
-			WriteErrorResponse(w, 401, "Invalid client_secret")
+	session, err := db.GetSessionBySessionId(stored.SessionID)
+	if err != nil {
+		WriteOauthErrorResponse(w, "invalid_grant", "The session of this refresh_token no longer exists")
+		return
+	}
+	// Checked before rotating so a bad resource parameter does not use up the refresh token
+	audience, scope, err := tokenAudience(r, session.Resources, session.Scope)
+	if err != nil {
+		writeTokenAudienceError(w, err)
+		return
+	}
+
+	newRefreshToken := utils.GenerateRefreshToken()
+	err = db.RotateRefreshToken(stored, utils.Sha256(newRefreshToken), time.Now().Add(seconds(app.Policy.RefreshTokenLifetime)))
+	if err != nil {
+		if errors.Is(err, db.ErrRefreshTokenReused) {
+			db.RevokeRefreshTokenFamily(stored.FamilyID)
+			WriteOauthErrorResponse(w, "invalid_grant", "The refresh_token was already used")
 			return
 		}
+		log.Println("Error rotating refresh token:", err)
+		WriteOauthErrorResponse(w, "server_error", "Failed to rotate refresh token")
+		return
+	}
+
+	// Refreshed ID tokens keep auth_time but never repeat the original nonce
+	res, err := issueTokens(tokenGrant{
+		ClientID:       stored.ClientID,
+		Username:       stored.Username,
+		Scope:          scope,
+		AuthTime:       session.AuthTime,
+		SessionID:      stored.SessionID,
+		Policy:         app.Policy,
+		Resources:      audience,
+		CertThumbprint: clientCertThumbprint(r, app),
+		DPoPJKT:        dpopKey(r),
+	})
+	if err != nil {
+		WriteOauthErrorResponse(w, "server_error", "Failed to generate tokens")
+		return
+	}
+	res["refresh_token"] = newRefreshToken
+	WriteOauthSuccessResponse(w, res)
+}
+
+// ClientCredentialsGrantHandler issues a token representing the app itself for
+// machine-to-machine calls. Only clients holding an app secret may use it.
+func ClientCredentialsGrantHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, authenticated, err := authenticateClient(r)
+	if err != nil || !authenticated || clientID == "system" {
+		WriteOauthErrorResponse(w, "invalid_client", "Client authentication failed")
+		return
 	}
 
-	accessToken, err := utils.GenerateJWTToken(session.ClientID, session.Username, time.Hour*24*7) // TODO: let app set token expiry
+	app, err := db.GetApplication(clientID)
 	if err != nil {
-		WriteErrorResponse(w, 500, "Failed to generate access token")
+		WriteOauthErrorResponse(w, "invalid_client", "Unknown client")
+		return
+	}
+	if app.SuspendUntil != nil {
+		t, err := time.Parse(time.RFC3339, *app.SuspendUntil)
+		if err == nil && t.After(time.Now()) {
+			WriteOauthErrorResponse(w, "unauthorized_client", "The application is suspended")
+			return
+		}
+	}
+	if !grantAllowed(app, "client_credentials") {
+		WriteOauthErrorResponse(w, "unauthorized_client", "The client credentials grant is not allowed for this application")
+		return
+	}
+
+	// Client tokens are always for the app itself
+	if len(r.Form["resource"]) > 0 {
+		WriteOauthErrorResponse(w, "invalid_target", "Client credentials tokens are always for the client itself")
+		return
+	}
+	// The supported scopes all describe a user, so none apply to an app acting as itself
+	if strings.TrimSpace(r.Form.Get("scope")) != "" {
+		WriteOauthErrorResponse(w, "invalid_scope", "No scopes are available to the client credentials grant")
 		return
 	}
 
-	idToken, err := utils.GenerateIDToken(session.ClientID, session.Username, "")
+	accessToken, err := utils.GenerateClientAccessToken(clientID, "", seconds(app.Policy.AccessTokenLifetime), confirmation(clientCertThumbprint(r, app), dpopKey(r)))
 	if err != nil {
-		WriteErrorResponse(w, 500, "Failed to generate ID token")
+		WriteOauthErrorResponse(w, "server_error", "Failed to generate token")
 		return
 	}
 
-	res := map[string]interface{}{
-		"token_type":   "Bearer",
+	if err := db.RecordClientCredentialsGrant(clientID, utils.GenerateToken()); err != nil {
+		log.Println("Error recording client credentials grant:", err)
+	}
+
+	// No refresh token: the client can always request a new token with its secret
+	WriteOauthSuccessResponse(w, map[string]interface{}{
+		"token_type":   tokenType(dpopKey(r)),
 		"access_token": accessToken,
-		"id_token":     idToken,
-		"expires_in":   604800, // 7 days in seconds
+		"expires_in":   app.Policy.AccessTokenLifetime,
+	})
+}
+
+var errInvalidClient = errors.New("invalid client credentials")
+
+// authenticateClient reads client credentials from the form body, HTTP Basic auth, a
+// client assertion or a client certificate, and enforces the app's registered method.
+// Only public clients may omit them; the returned flag reports whether the client proved
+// its identity.
+func authenticateClient(r *http.Request) (string, bool, error) {
+	clientID, method, err := clientCredentials(r)
+	if err != nil {
+		return "", false, err
+	}
+
+	app, err := db.GetApplication(clientID)
+	if err != nil {
+		return "", false, errInvalidClient
+	}
+	if method == "none" {
+		if thumbprint, certMethod := matchClientCert(r, app); thumbprint != "" {
+			method = certMethod
+		}
+	}
+	if app.TokenEndpointAuthMethod != "" && app.TokenEndpointAuthMethod != method {
+		return "", false, errInvalidClient
+	}
+	if method != "none" {
+		return clientID, true, nil
+	}
+
+	confidential, err := clientIsConfidential(app)
+	if err != nil {
+		log.Println("Error checking client credentials:", err)
+		return "", false, errInvalidClient
+	}
+	if confidential {
+		return "", false, errInvalidClient
+	}
+	return clientID, false, nil
+}
+
+// clientCredentials verifies the credentials sent with the request and names the method
+// used, or none when the client only sent its client_id.
+func clientCredentials(r *http.Request) (string, string, error) {
+	if hasClientAssertion(r) {
+		return authenticateClientAssertion(r)
+	}
+
+	clientID := r.Form.Get("client_id")
+	clientSecret := r.Form.Get("client_secret")
+	method := "client_secret_post"
+	if username, password, ok := r.BasicAuth(); ok {
+		if clientID == "" {
+			clientID = username
+		}
+		if clientSecret == "" {
+			clientSecret, method = password, "client_secret_basic"
+		}
+	}
+
+	if clientID == "" {
+		return "", "", errInvalidClient
+	}
+	if clientSecret == "" {
+		return clientID, "none", nil
+	}
+	if !db.ValidateAppSecret(clientID, clientSecret) {
+		return "", "", errInvalidClient
+	}
+	return clientID, method, nil
+}
+
+// RevokeTokenHandler implements RFC 7009 for refresh tokens, access tokens and ID tokens.
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request", "Use POST")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		WriteOauthErrorResponse(w, "invalid_request", "Malformed request body")
+		return
+	}
+
+	token := r.Form.Get("token")
+	if token == "" {
+		WriteOauthErrorResponse(w, "invalid_request", "token is required")
+		return
+	}
+
+	clientID, _, err := authenticateClient(r)
+	if err != nil {
+		WriteOauthErrorResponse(w, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	hint := r.Form.Get("token_type_hint")
+	if hint != "access_token" {
+		stored, err := db.GetRefreshToken(utils.Sha256(token))
+		if err == nil {
+			if stored.ClientID != clientID {
+				WriteOauthErrorResponse(w, "unauthorized_client", "The token was issued to another client")
+				return
+			}
+			if err := db.RevokeRefreshTokenFamily(stored.FamilyID); err != nil {
+				WriteOauthErrorResponse(w, "server_error", "Failed to revoke token")
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	claims, err := utils.ParseAnyToken(token)
+	if err != nil {
+		// Invalid or already expired tokens need no action (RFC 7009 section 2.2)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	owner, _ := claims["appId"].(string)
+	if owner == "" {
+		owner, _ = claims["aud"].(string)
+	}
+	if owner != clientID {
+		WriteOauthErrorResponse(w, "unauthorized_client", "The token was issued to another client")
+		return
+	}
+
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || err != nil || exp == nil {
+		log.Printf("RevokeTokenHandler - token for client %s has no jti or exp, cannot revoke", clientID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := db.RevokeToken(jti, clientID, exp.Time); err != nil {
+		WriteOauthErrorResponse(w, "server_error", "Failed to revoke token")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// IntrospectTokenHandler implements RFC 7662. Only confidential clients may introspect, and
+// only tokens issued to themselves; anything else is reported as inactive.
+func IntrospectTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request", "Use POST")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		WriteOauthErrorResponse(w, "invalid_request", "Malformed request body")
+		return
+	}
+
+	token := r.Form.Get("token")
+	if token == "" {
+		WriteOauthErrorResponse(w, "invalid_request", "token is required")
+		return
+	}
+
+	clientID, authenticated, err := authenticateClient(r)
+	if err != nil || !authenticated {
+		WriteOauthErrorResponse(w, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	inactive := map[string]interface{}{"active": false}
+	issuer := strings.TrimSuffix(config.AppConfig.BackendURL, "/")
+
+	if r.Form.Get("token_type_hint") != "access_token" {
+		stored, err := db.GetRefreshToken(utils.Sha256(token))
+		if err == nil {
+			exp, err := time.Parse(time.RFC3339, stored.ExpiresAt)
+			if stored.ClientID != clientID || stored.Status != "active" || err != nil || time.Now().After(exp) {
+				WriteOauthSuccessResponse(w, inactive)
+				return
+			}
+			WriteOauthSuccessResponse(w, map[string]interface{}{
+				"active":     true,
+				"token_type": "refresh_token",
+				"client_id":  stored.ClientID,
+				"sub":        stored.Username,
+				"username":   stored.Username,
+				"exp":        exp.Unix(),
+				"iss":        issuer,
+				"aud":        stored.ClientID,
+			})
+			return
+		}
+	}
+
+	claims, err := utils.ParseAnyToken(token)
+	if err != nil {
+		WriteOauthSuccessResponse(w, inactive)
+		return
+	}
+
+	// Access tokens carry appId/username, ID tokens carry aud/sub
+	aud, _ := claims.GetAudience()
+	owner, _ := claims["appId"].(string)
+	if owner == "" && len(aud) > 0 {
+		owner = aud[0]
+	}
+	subject, _ := claims["sub"].(string)
+	username, _ := claims["username"].(string)
+	if subject == "" {
+		subject = username
+	}
+	// ID tokens only carry sub; client_credentials tokens have the app as subject and no user
+	if username == "" && subject != owner {
+		username = subject
+	}
+	if len(aud) == 0 {
+		aud = []string{owner}
+	}
+
+	// Resource servers may introspect tokens issued for their registered APIs
+	allowed := owner == clientID || slices.Contains(aud, clientID)
+	if !allowed {
+		allowed, err = db.OwnsAnyResource(clientID, aud)
+		if err != nil {
+			log.Println("Error checking resource ownership:", err)
+		}
+	}
+	if !allowed {
+		WriteOauthSuccessResponse(w, inactive)
+		return
+	}
+
+	var audience interface{} = aud
+	if len(aud) == 1 {
+		audience = aud[0]
+	}
+	// Exchanged tokens are addressed to one app but were requested by another
+	tokenClient, _ := claims["client_id"].(string)
+	if tokenClient == "" {
+		tokenClient = owner
+	}
+
+	res := map[string]interface{}{
+		"active":     true,
+		"token_type": "Bearer",
+		"client_id":  tokenClient,
+		"sub":        subject,
+		"iss":        claims["iss"],
+		"aud":        audience,
+	}
+	if username != "" {
+		res["username"] = username
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		res["exp"] = exp.Unix()
+	}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		res["iat"] = iat.Unix()
+	}
+	if scope, ok := claims["scope"].(string); ok {
+		res["scope"] = scope
+	}
+	if cnf, ok := claims["cnf"].(map[string]interface{}); ok {
+		res["cnf"] = cnf
+		if _, ok := cnf["jkt"]; ok {
+			res["token_type"] = "DPoP"
+		}
 	}
-	db.UpdateSessionStatus(session.SessionID, "consumed", "")
-	db.AddHistory(session.Username, session.ClientID)
 	WriteOauthSuccessResponse(w, res)
 }
 
+// User code guessing limits. An IP is locked out after too many unknown codes, and a code
+// after too many lookups, which would mean it is being shared or attacked.
+const (
+	userCodeFailuresPerIP  = 10
+	userCodeLookupsPerCode = 10
+	userCodeLockout        = 15 * time.Minute
+)
+
 func SessionDetailsByUsercodeHandler(w http.ResponseWriter, r *http.Request) {
-	userCode := r.URL.Query().Get("userCode")
+	userCode := utils.NormalizeUserCode(r.URL.Query().Get("userCode"))
 	if userCode == "" {
 		WriteErrorResponse(w, 400, "Missing userCode")
 		return
 	}
 
+	ipKey, codeKey := "ip:"+utils.ClientIP(r), "code:"+userCode
+	for _, key := range []string{ipKey, codeKey} {
+		locked, err := db.DeviceCodeLocked(key)
+		if err != nil {
+			log.Println("Error checking user code lockout:", err)
+			WriteErrorResponse(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if locked {
+			WriteErrorResponse(w, http.StatusTooManyRequests, "Too many attempts, please try again later")
+			return
+		}
+	}
+
 	session, err := db.GetActiveSessionByUserCode(userCode)
 	if err != nil {
+		if _, err := db.RecordDeviceCodeAttempt(ipKey, userCodeFailuresPerIP, userCodeLockout); err != nil {
+			log.Println("Error recording user code attempt:", err)
+		}
 		WriteErrorResponse(w, 400, "Invalid userCode")
 		return
 	}
-	res := map[string]string{
-		"sessionId": session.SessionID,
-		"appId":     session.ClientID,
-		"status":    session.Status,
-		"expiresAt": session.ExpiresAt,
+	if _, err := db.RecordDeviceCodeAttempt(codeKey, userCodeLookupsPerCode, userCodeLockout); err != nil {
+		log.Println("Error recording user code attempt:", err)
+	}
+
+	res := map[string]interface{}{
+		"sessionId":       session.SessionID,
+		"appId":           session.ClientID,
+		"status":          session.Status,
+		"scope":           session.Scope,
+		"scopes":          strings.Fields(session.Scope),
+		"expiresAt":       session.ExpiresAt,
+		"deviceIp":        session.DeviceIP,
+		"deviceUserAgent": session.DeviceUserAgent,
 	}
 	WriteSuccessResponse(w, "Success", res)
 }
 
 func OAuthConsentHandler(w http.ResponseWriter, r *http.Request) {
 	username := GetUsernameFromContext(r.Context())
+	authTime := time.Now()
 	if username == "" {
 		claims, err := utils.ExtractClaims(r)
 		if err != nil {
@@ -300,6 +1033,10 @@ func OAuthConsentHandler(w http.ResponseWriter, r *http.Request) {
 			WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
 			return
 		}
+		// The dashboard token is minted at login, so its iat is when the user last authenticated
+		if !claims.IssuedAt.IsZero() {
+			authTime = claims.IssuedAt
+		}
 	}
 
 	var req struct {
@@ -312,6 +1049,12 @@ func OAuthConsentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	session, err := db.GetSessionBySessionId(req.SessionID)
+	if err != nil {
+		WriteErrorResponse(w, 400, "Invalid sessionId")
+		return
+	}
+
 	status := "denied"
 	if req.Approve {
 		status = "authorized"
@@ -322,6 +1065,14 @@ func OAuthConsentHandler(w http.ResponseWriter, r *http.Request) {
 		WriteErrorResponse(w, 500, "Failed to update session status")
 		return
 	}
+	if req.Approve {
+		db.SetSessionAuthTime(req.SessionID, authTime)
+		if session.Status == "pending" {
+			if err := db.SaveGrant(username, session.ClientID, session.Scope); err != nil {
+				log.Print("Failed to save grant:", err)
+			}
+		}
+	}
 	WriteSuccessResponse(w, "Consent recorded", nil)
 }
 
@@ -342,75 +1093,177 @@ func SessionDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		"appId":     session.ClientID,
 		"username":  session.Username,
 		"status":    session.Status,
+		"scope":     session.Scope,
+		"scopes":    strings.Fields(session.Scope),
 		"expiresAt": session.ExpiresAt,
 	}
+	if session.FlowType == "device_code" {
+		// Lets the user check that the device asking for access is theirs
+		resp["deviceIp"] = session.DeviceIP
+		resp["deviceUserAgent"] = session.DeviceUserAgent
+	}
+	if session.FlowType == "authorization_code" {
+		resp["prompt"] = session.Prompt
+		resp["maxAge"] = session.MaxAge
+		resp["loginHint"] = session.LoginHint
+		// Named on the consent screen so the user sees which APIs the app will reach
+		resp["resources"] = []types.APIResource{}
+		if resources, err := db.GetAPIResourcesByIdentifier(session.Resources); err == nil && resources != nil {
+			resp["resources"] = resources
+		}
+		// Tell a signed-in browser up front whether it has to sign in again or approve the app
+		if claims, err := utils.ExtractClaims(r); err == nil {
+			resp["loginRequired"] = loginTooOld(session.Prompt, session.MaxAge, session.CreatedAt, claims.IssuedAt)
+			if required, err := consentRequired(session.ClientID, session.Prompt, session.Scope, claims.Username); err == nil {
+				resp["consentRequired"] = required
+			}
+		}
+	}
 	WriteSuccessResponse(w, "Success", resp)
 }
 
-func AuthCodeFlowHandler(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	req := types.AuthCodeFlowRequest{
+// parseAuthorizationRequest validates authorization request parameters, whether they came
+// from the query string or a pushed request.
+func parseAuthorizationRequest(q url.Values) (*types.AuthCodeFlowRequest, *types.Application, *authorizeError) {
+	req := &types.AuthCodeFlowRequest{
 		ResponseType:        q.Get("response_type"),
 		ClientID:            q.Get("client_id"),
 		RedirectURI:         q.Get("redirect_uri"),
 		State:               q.Get("state"),
 		CodeChallenge:       q.Get("code_challenge"),
 		CodeChallengeMethod: q.Get("code_challenge_method"),
+		Scope:               q.Get("scope"),
+		Nonce:               q.Get("nonce"),
+		LoginHint:           q.Get("login_hint"),
 	}
 
+	// Until the client and its redirect_uri are verified, errors can only be shown to the user
+	app, err := db.GetApplication(req.ClientID)
+	if err != nil {
+		return req, nil, &authorizeError{code: "invalid_client", description: "Unknown client_id"}
+	}
 	if req.RedirectURI == "" {
-		http.Error(w, "missing redirect_uri", http.StatusBadRequest)
-		return
+		return req, app, &authorizeError{code: "invalid_request", description: "redirect_uri is required"}
 	}
-
-	redirectTarget := req.RedirectURI
-	if strings.Contains(redirectTarget, "?") {
-		redirectTarget += "&"
-	} else {
-		redirectTarget += "?"
+	trusted, err := db.IsTrustedURI(req.ClientID, req.RedirectURI)
+	if err != nil {
+		log.Print("Failed to validate trusted URI:", err)
+		return req, app, &authorizeError{code: "server_error", description: "Failed to validate redirect_uri"}
 	}
-
-	if req.ResponseType != "code" {
-		http.Redirect(w, r, redirectTarget+"error=unsupported_response_type&state="+req.State, http.StatusFound)
-		return
+	if !trusted {
+		return req, app, &authorizeError{code: "invalid_request", description: "redirect_uri is not registered for this application"}
 	}
 
-	app, err := db.GetApplication(req.ClientID)
-	if err != nil {
-		http.Redirect(w, r, redirectTarget+"error=invalid_client&state="+req.State, http.StatusFound)
-		return
+	fail := func(code string, description string) (*types.AuthCodeFlowRequest, *types.Application, *authorizeError) {
+		return req, app, &authorizeError{code: code, description: description, redirect: true}
 	}
 	if app.SuspendUntil != nil {
 		t, _ := time.Parse(time.RFC3339, *app.SuspendUntil)
 		if t.After(time.Now()) {
-			http.Redirect(w, r, redirectTarget+"error=access_denied&state="+req.State, http.StatusFound)
-			return
+			return fail("access_denied", "The application is suspended")
 		}
 	}
+	if req.ResponseType != "code" {
+		return fail("unsupported_response_type", "Only the code response type is supported")
+	}
 
-	trusted, err := db.IsTrustedURI(req.ClientID, req.RedirectURI)
+	if req.CodeChallengeMethod == "" {
+		req.CodeChallengeMethod = "plain"
+	} else if req.CodeChallengeMethod != "plain" && req.CodeChallengeMethod != "S256" {
+		return fail("invalid_request", "Unsupported code_challenge_method")
+	}
+
+	if !grantAllowed(app, "authorization_code") {
+		return fail("unauthorized_client", "The authorization code grant is not allowed for this application")
+	}
+	if req.CodeChallenge == "" && app.Policy.RequirePKCE {
+		return fail("invalid_request", "PKCE is required for this application")
+	}
+	if req.CodeChallenge != "" && req.CodeChallengeMethod == "plain" && !app.Policy.AllowPlainPKCE {
+		return fail("invalid_request", "The plain code_challenge_method is not allowed for this application")
+	}
+	if oauth21Strict(app) && (req.CodeChallenge == "" || req.CodeChallengeMethod != "S256") {
+		return fail("invalid_request", "PKCE with S256 is required for this application")
+	}
+
+	// Scopes of the requested API resources become available alongside the standard ones
+	resources, err := lookupResources(q["resource"])
 	if err != nil {
-		log.Print("Failed to validate trusted URI:", err)
-		http.Error(w, "server error", http.StatusInternalServerError)
-		return
+		if errors.Is(err, errInvalidTarget) {
+			return fail("invalid_target", "Unknown resource")
+		}
+		log.Print("Failed to look up resources:", err)
+		return fail("server_error", "Failed to look up resources")
 	}
-	if !trusted {
-		http.Error(w, "redirect_uri not registered", http.StatusBadRequest)
+	for _, res := range resources {
+		req.Resources = append(req.Resources, res.Identifier)
+	}
+	req.Scope, err = utils.NormalizeScopeWith(req.Scope, resourceScopes(resources))
+	if err != nil {
+		return fail("invalid_scope", err.Error())
+	}
+
+	req.Prompt, err = parsePrompt(q.Get("prompt"))
+	if err != nil {
+		return fail("invalid_request", err.Error())
+	}
+	if raw := q.Get("max_age"); raw != "" {
+		maxAge, err := strconv.Atoi(raw)
+		if err != nil || maxAge < 0 {
+			return fail("invalid_request", "max_age must be a non-negative integer")
+		}
+		req.MaxAge = &maxAge
+	}
+	// The hint only prefills the login form, so an oversized one is dropped rather than rejected
+	if len(req.LoginHint) > 255 {
+		req.LoginHint = ""
+	}
+
+	return req, app, nil
+}
+
+func AuthCodeFlowHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	// A pushed request replaces the query parameters entirely
+	pushed := false
+	if requestURI := q.Get("request_uri"); requestURI != "" {
+		params, err := db.ConsumePushedAuthRequest(strings.TrimPrefix(requestURI, parRequestURIPrefix), q.Get("client_id"))
+		if err != nil {
+			writeErrorPage(w, "invalid_request_uri", "The request_uri is invalid or has expired")
+			return
+		}
+		q, pushed = params, true
+	}
+
+	q, signed, aerr := unpackRequestObject(q)
+	if aerr != nil {
+		writeErrorPage(w, aerr.code, aerr.description)
 		return
 	}
 
-	if req.CodeChallengeMethod == "" {
-		req.CodeChallengeMethod = "plain"
-	} else if req.CodeChallengeMethod != "plain" && req.CodeChallengeMethod != "S256" {
-		http.Error(w, "unsupported code_challenge_method", http.StatusBadRequest)
+	// Pushed requests had their signature requirement enforced when they were pushed
+	req, app, aerr := parseAuthorizationRequest(q)
+	if aerr == nil && app.Policy.RequirePAR && !pushed {
+		aerr = &authorizeError{code: "invalid_request", description: "This application only accepts pushed authorization requests", redirect: true}
+	}
+	if aerr == nil && app.Policy.RequireSignedRequest && !signed && !pushed {
+		aerr = &authorizeError{code: "invalid_request", description: "This application only accepts signed request objects", redirect: true}
+	}
+	if aerr != nil {
+		if aerr.redirect {
+			redirectAuthorizeError(w, r, req.RedirectURI, req.State, aerr)
+		} else {
+			writeErrorPage(w, aerr.code, aerr.description)
+		}
 		return
 	}
 
 	sessionId := utils.GenerateToken()
-	err = db.CreateAuthCodeSession(req.ClientID, sessionId, req.RedirectURI, req.CodeChallenge, req.CodeChallengeMethod, req.State)
+	err := db.CreateAuthCodeSession(sessionId, req)
 	if err != nil {
 		log.Println("Error creating auth code session:", err)
-		http.Error(w, "server error", http.StatusInternalServerError)
+		redirectAuthorizeError(w, r, req.RedirectURI, req.State, &authorizeError{code: "server_error", description: "Failed to start the authorization"})
 		return
 	}
 
@@ -429,21 +1282,52 @@ func OIDCConfigurationHandler(w http.ResponseWriter, r *http.Request) {
 	// Ensure no trailing slash
 	baseURL = strings.TrimSuffix(baseURL, "/")
 
+	// Under server-wide OAuth 2.1 strict mode only S256 is accepted, unless an app opts out
+	codeChallengeMethods := []string{"plain", "S256"}
+	if config.AppConfig.OAuth21Strict {
+		codeChallengeMethods = []string{"S256"}
+	}
+
 	resp := map[string]interface{}{
-		"issuer":                                baseURL,
-		"authorization_endpoint":                baseURL + "/oauth2/authorize",
-		"token_endpoint":                        baseURL + "/oauth2/token",
-		"userinfo_endpoint":                     baseURL + "/userinfo",
-		"device_authorization_endpoint":         baseURL + "/oauth2/devicecode",
-		"jwks_uri":                              baseURL + "/.well-known/jwks.json",
-		"response_types_supported":              []string{"code", "token", "id_token"},
-		"subject_types_supported":               []string{"public"},
-		"id_token_signing_alg_values_supported": []string{"RS256"},
-		"scopes_supported":                      []string{"openid", "profile", "email"},
-		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
-		"claims_supported":                      []string{"sub", "iss", "exp", "iat", "username", "nickname", "avatarUrl", "email"},
-		"code_challenge_methods_supported":      []string{"plain", "S256"},
-		"grant_types_supported":                 []string{"authorization_code", "urn:ietf:params:oauth:grant-type:device_code"},
+		"issuer":                                           baseURL,
+		"authorization_endpoint":                           baseURL + "/oauth2/authorize",
+		"token_endpoint":                                   baseURL + "/oauth2/token",
+		"revocation_endpoint":                              baseURL + "/oauth2/revoke",
+		"end_session_endpoint":                             baseURL + "/oauth2/logout",
+		"introspection_endpoint":                           baseURL + "/oauth2/introspect",
+		"registration_endpoint":                            baseURL + "/oauth2/register",
+		"pushed_authorization_request_endpoint":            baseURL + "/oauth2/par",
+		"require_pushed_authorization_requests":            false,
+		"request_parameter_supported":                      true,
+		"request_uri_parameter_supported":                  false,
+		"request_object_signing_alg_values_supported":      utils.ClientSigningAlgs,
+		"userinfo_endpoint":                                baseURL + "/userinfo",
+		"device_authorization_endpoint":                    baseURL + "/oauth2/devicecode",
+		"jwks_uri":                                         baseURL + "/.well-known/jwks.json",
+		"response_types_supported":                         []string{"code"},
+		"subject_types_supported":                          []string{"public"},
+		"id_token_signing_alg_values_supported":            []string{"RS256"},
+		"scopes_supported":                                 utils.SupportedScopes,
+		"prompt_values_supported":                          supportedPromptValues,
+		"token_endpoint_auth_methods_supported":            append(slices.Clone(clientAuthMethods), "none"),
+		"token_endpoint_auth_signing_alg_values_supported": append(slices.Clone(utils.ClientSecretJWTAlgs), utils.ClientSigningAlgs...),
+		"revocation_endpoint_auth_methods_supported":       append(slices.Clone(clientAuthMethods), "none"),
+		"introspection_endpoint_auth_methods_supported":    clientAuthMethods,
+		"tls_client_certificate_bound_access_tokens":       true,
+		"dpop_signing_alg_values_supported":                utils.ClientSigningAlgs,
+		"claims_supported":                                 []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "at_hash", "azp", "sid", "username", "nickname", "avatarUrl", "email"},
+		"code_challenge_methods_supported":                 codeChallengeMethods,
+		"backchannel_logout_supported":                     true,
+		"backchannel_logout_session_supported":             true,
+		"grant_types_supported":                            supportedGrantTypes,
+	}
+	if mtlsURL := strings.TrimSuffix(config.AppConfig.MTLSBackendURL, "/"); mtlsURL != "" {
+		resp["mtls_endpoint_aliases"] = map[string]string{
+			"token_endpoint":                        mtlsURL + "/oauth2/token",
+			"revocation_endpoint":                   mtlsURL + "/oauth2/revoke",
+			"introspection_endpoint":                mtlsURL + "/oauth2/introspect",
+			"pushed_authorization_request_endpoint": mtlsURL + "/oauth2/par",
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -494,13 +1378,6 @@ func AuthCodeFlowConsentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	redirectTarget := session.RedirectURI
-	if strings.Contains(redirectTarget, "?") {
-		redirectTarget += "&"
-	} else {
-		redirectTarget += "?"
-	}
-
 	// If already handled, just return the target (idempotency-ish)
 	if session.Status != "pending" {
 		target := config.AppConfig.FrontendURL + "/auth?session_id=" + sessID
@@ -513,25 +1390,151 @@ func AuthCodeFlowConsentHandler(w http.ResponseWriter, r *http.Request) {
 	if !approve {
 		// User denied
 		db.UpdateSessionStatus(sessID, "denied", username)
-		target := redirectTarget + "error=access_denied&state=" + session.State
+		target := authorizationResponseURL(session.RedirectURI, map[string]string{
+			"error":             "access_denied",
+			"error_description": "The user denied the request",
+			"state":             session.State,
+		})
 		WriteSuccessResponse(w, "Access Denied", map[string]string{
 			"redirectUrl": target,
 		})
 		return
 	}
 
-	// Approved
-	authCode := utils.GenerateToken()
-	err = db.UpdateAuthCodeSessionCode(sessID, authCode, username)
+	// Approved, unless the app asked for a fresher sign-in than this one
+	if loginTooOld(session.Prompt, session.MaxAge, session.CreatedAt, claims.IssuedAt) {
+		WriteErrorResponse(w, http.StatusForbidden, "Please sign in again to continue")
+		return
+	}
+
+	target, err := authorizeAuthCodeSession(session, claims)
 	if err != nil {
 		log.Print("Failed to update auth code session:", err)
 		WriteErrorResponse(w, http.StatusInternalServerError, "Database error")
 		return
 	}
+	if err := db.SaveGrant(username, session.ClientID, session.Scope); err != nil {
+		log.Print("Failed to save grant:", err)
+	}
+	WriteSuccessResponse(w, "Authorized", map[string]string{
+		"redirectUrl": target,
+	})
+}
+
+// AuthCodeSilentHandler completes a request without showing the consent screen. A code is
+// issued only if the browser is signed in recently enough and no consent is required. For
+// prompt=none the app otherwise gets login_required or consent_required; other requests
+// get an error so the frontend falls back to the consent screen.
+func AuthCodeSilentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteErrorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" {
+		WriteErrorResponse(w, http.StatusBadRequest, "Missing sessionId")
+		return
+	}
+
+	session, err := db.GetAuthCodeSessionBySessionId(req.SessionID)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid session")
+		return
+	}
+	if session.Status != "pending" {
+		WriteErrorResponse(w, http.StatusBadRequest, "Session cannot be authorized silently")
+		return
+	}
+	silent := session.Prompt == "none"
+
+	fail := func(code string, description string) {
+		db.UpdateSessionStatus(session.SessionID, "denied", "")
+		WriteSuccessResponse(w, "Not authorized", map[string]string{
+			"redirectUrl": authorizationResponseURL(session.RedirectURI, map[string]string{
+				"error":             code,
+				"error_description": description,
+				"state":             session.State,
+			}),
+		})
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil || loginTooOld(session.Prompt, session.MaxAge, session.CreatedAt, claims.IssuedAt) {
+		if !silent {
+			WriteErrorResponse(w, http.StatusForbidden, "Please sign in again to continue")
+			return
+		}
+		fail("login_required", "The user must sign in")
+		return
+	}
+	required, err := consentRequired(session.ClientID, session.Prompt, session.Scope, claims.Username)
+	if err != nil {
+		log.Print("Failed to check consent:", err)
+		WriteErrorResponse(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if required {
+		if !silent {
+			WriteErrorResponse(w, http.StatusForbidden, "Consent required")
+			return
+		}
+		fail("consent_required", "The user must approve the application")
+		return
+	}
 
-	// Construct Success Redirect
-	target := redirectTarget + "code=" + authCode + "&state=" + session.State
+	target, err := authorizeAuthCodeSession(session, claims)
+	if err != nil {
+		log.Print("Failed to update auth code session:", err)
+		WriteErrorResponse(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	// First-party apps never reach the consent screen, so their grant is recorded here to
+	// list them among the user's connected apps
+	if app, err := db.GetApplication(session.ClientID); err == nil && app.FirstParty {
+		if err := db.SaveGrant(claims.Username, session.ClientID, session.Scope); err != nil {
+			log.Print("Failed to save grant:", err)
+		}
+	}
 	WriteSuccessResponse(w, "Authorized", map[string]string{
 		"redirectUrl": target,
 	})
 }
+
+// consentRequired reports whether the user has to approve the app for scope: always with
+// prompt=consent, never for first-party apps, and otherwise unless an earlier grant covers it.
+func consentRequired(clientID string, prompt string, scope string, username string) (bool, error) {
+	if slices.Contains(strings.Fields(prompt), "consent") {
+		return true, nil
+	}
+	app, err := db.GetApplication(clientID)
+	if err != nil {
+		return true, err
+	}
+	if app.FirstParty {
+		return false, nil
+	}
+	granted, err := db.HasGrant(username, clientID, scope)
+	return !granted, err
+}
+
+// authorizeAuthCodeSession issues the authorization code for an approved session and
+// returns the redirect back to the app.
+func authorizeAuthCodeSession(session *types.AuthCodeFlowSession, claims *utils.Claims) (string, error) {
+	authCode := utils.GenerateToken()
+	if err := db.UpdateAuthCodeSessionCode(session.SessionID, authCode, claims.Username); err != nil {
+		return "", err
+	}
+	authTime := claims.IssuedAt
+	if authTime.IsZero() {
+		authTime = time.Now()
+	}
+	db.SetSessionAuthTime(session.SessionID, authTime)
+
+	return authorizationResponseURL(session.RedirectURI, map[string]string{
+		"code":  authCode,
+		"state": session.State,
+	}), nil
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WriteOauthErrorResponse writes an RFC 6749 section 5.2 error with the status its code calls for.
+func WriteOauthErrorResponse(w http.ResponseWriter, code string, description string) {
+	writeOAuthError(w, oauthErrorStatus(code), code, description)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code string, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="MirPass"`)
+	}
+	res := map[string]string{"error": code}
+	if description != "" {
+		res["error_description"] = description
+	}
+	w.Header().Set("Content-Type", "application/json")
+	noStore(w)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// oauthErrorStatus is 401 for failed client authentication, 5xx for server trouble and
+// 400 for everything else.
+func oauthErrorStatus(code string) int {
+	switch code {
+	case "invalid_client":
+		return http.StatusUnauthorized
+	case "server_error":
+		return http.StatusInternalServerError
+	case "temporarily_unavailable":
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// noStore keeps tokens and credentials out of caches (RFC 6749 section 5.1).
+func noStore(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+}
+
+// authorizeError rejects an authorization request. Once the client and its redirect_uri
+// are verified the error goes back to the app (redirect is set); before that it is shown
+// to the user, since redirecting to an unverified URI would make MirPass an open redirector.
+type authorizeError struct {
+	code        string
+	description string
+	redirect    bool
+}
+
+// authorizationResponseURL appends authorization response parameters to a redirect URI,
+// leaving out empty ones such as a missing state.
+func authorizationResponseURL(redirectURI string, params map[string]string) string {
+	values := url.Values{}
+	for k, v := range params {
+		if v != "" {
+			values.Set(k, v)
+		}
+	}
+	sep := "?"
+	if strings.Contains(redirectURI, "?") {
+		sep = "&"
+	}
+	return redirectURI + sep + values.Encode()
+}
+
+// redirectAuthorizeError sends an authorization error back to the app (RFC 6749 section 4.1.2.1).
+func redirectAuthorizeError(w http.ResponseWriter, r *http.Request, redirectURI, state string, aerr *authorizeError) {
+	http.Redirect(w, r, authorizationResponseURL(redirectURI, map[string]string{
+		"error":             aerr.code,
+		"error_description": aerr.description,
+		"state":             state,
+	}), http.StatusFound)
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Sign-in error - MirPass</title></head>
+<body style="font-family: sans-serif; max-width: 32rem; margin: 4rem auto; padding: 0 1rem">
+<h1>Something went wrong</h1>
+<p>{{.Description}}</p>
+<p><small>Error: {{.Code}}</small></p>
+</body>
+</html>
+`))
+
+// writeErrorPage tells the user about a browser request that cannot be returned to the app.
+func writeErrorPage(w http.ResponseWriter, code string, description string) {
+	status := http.StatusBadRequest
+	if code == "server_error" {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	noStore(w)
+	w.WriteHeader(status)
+	errorPage.Execute(w, map[string]string{"Code": code, "Description": description})
+}
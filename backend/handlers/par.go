@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"mirpass-backend/db"
+	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"net/http"
+	"time"
+)
+
+const (
+	parRequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+	parLifetime         = 90 * time.Second
+)
+
+// PushedAuthorizationHandler implements RFC 9126. The client posts its authorization
+// request here and sends only the returned request_uri through the browser.
+func PushedAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request", "Use POST")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		WriteOauthErrorResponse(w, "invalid_request", "Malformed request body")
+		return
+	}
+
+	// Confidential clients must authenticate here as at the token endpoint (RFC 9126 section 2)
+	clientID, _, err := authenticateClient(r)
+	if err != nil || clientID == "system" {
+		WriteOauthErrorResponse(w, "invalid_client", "Client authentication failed")
+		return
+	}
+	if r.PostForm.Get("request_uri") != "" {
+		WriteOauthErrorResponse(w, "invalid_request", "request_uri cannot be pushed")
+		return
+	}
+
+	// Keep only the authorization parameters; the credentials must not be stored
+	params := r.PostForm
+	params.Del("client_secret")
+	params.Del("client_assertion")
+	params.Del("client_assertion_type")
+	params.Set("client_id", clientID)
+
+	params, signed, aerr := unpackRequestObject(params)
+	if aerr == nil {
+		var app *types.Application
+		_, app, aerr = parseAuthorizationRequest(params)
+		if aerr == nil && app.Policy.RequireSignedRequest && !signed {
+			aerr = &authorizeError{code: "invalid_request", description: "This application only accepts signed request objects"}
+		}
+	}
+	if aerr != nil {
+		WriteOauthErrorResponse(w, aerr.code, aerr.description)
+		return
+	}
+
+	requestID := utils.GenerateToken()
+	if err := db.CreatePushedAuthRequest(requestID, clientID, params.Encode(), time.Now().Add(parLifetime)); err != nil {
+		log.Println("Error storing pushed authorization request:", err)
+		WriteOauthErrorResponse(w, "server_error", "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	noStore(w)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"request_uri": parRequestURIPrefix + requestID,
+		"expires_in":  int(parLifetime.Seconds()),
+	})
+}
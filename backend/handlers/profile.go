@@ -39,6 +39,69 @@ func GetUserAppsSummaryHandler(w http.ResponseWriter, r *http.Request) {
 	WriteSuccessResponse(w, "Summary fetched", summary)
 }
 
+// ListConnectedAppsHandler lists the apps the user has approved and the scopes they granted.
+func ListConnectedAppsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	apps, err := db.ListConnectedApps(claims.Username)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Failed to get connected apps")
+		return
+	}
+
+	for i := range apps {
+		apps[i].LogoUrl = FormatUrl(apps[i].LogoUrl)
+	}
+
+	WriteSuccessResponse(w, "Connected apps fetched", apps)
+}
+
+// RevokeConnectedAppHandler withdraws the user's consent for an app. The app's tokens stop
+// working and the next sign-in asks for consent again.
+func RevokeConnectedAppHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		AppID string `json:"appId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AppID == "" {
+		WriteErrorResponse(w, http.StatusBadRequest, "App ID is required")
+		return
+	}
+
+	app, err := db.GetApplication(req.AppID)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusNotFound, "App is not connected")
+		return
+	}
+
+	lifetime := max(app.Policy.AccessTokenLifetime, app.Policy.IDTokenLifetime)
+	revoked, err := db.RevokeGrant(claims.Username, req.AppID, seconds(lifetime))
+	if err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Failed to revoke access")
+		return
+	}
+	if !revoked {
+		WriteErrorResponse(w, http.StatusNotFound, "App is not connected")
+		return
+	}
+
+	WriteSuccessResponse(w, "Access revoked", nil)
+}
+
 func GetLoginHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	claims, err := utils.ExtractClaims(r)
 	if err != nil {
@@ -214,6 +277,7 @@ func UpdatePasswordHandler(w http.ResponseWriter, r *http.Request) {
 		WriteErrorResponse(w, http.StatusInternalServerError, "Failed to update password")
 		return
 	}
+	endUserSessions(username, "password_change", true)
 
 	WriteSuccessResponse(w, "Password updated successfully", nil)
 }
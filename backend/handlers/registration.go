@@ -0,0 +1,408 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mirpass-backend/config"
+	"mirpass-backend/db"
+	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const registrationPath = "/oauth2/register"
+
+var supportedClientAuthMethods = []string{"client_secret_basic", "client_secret_post", "client_secret_jwt", "private_key_jwt", "tls_client_auth", "self_signed_tls_client_auth", "none"}
+
+// writeRegistrationError writes an RFC 7591 error. A 401 also carries the Bearer challenge.
+func writeRegistrationError(w http.ResponseWriter, status int, code string, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer error="`+code+`"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	noStore(w)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+func writeClientInformation(w http.ResponseWriter, status int, info *types.ClientInformation) {
+	w.Header().Set("Content-Type", "application/json")
+	noStore(w)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(info)
+}
+
+func bearerToken(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return ""
+	}
+	return parts[1]
+}
+
+func registrationClientURI(clientID string) string {
+	return strings.TrimSuffix(config.AppConfig.BackendURL, "/") + registrationPath + "/" + url.PathEscape(clientID)
+}
+
+// validateClientMetadata fills in RFC 7591 defaults and checks the metadata. It returns
+// an error code and description for the client, or "" when the metadata is acceptable.
+func validateClientMetadata(meta *types.ClientMetadata) (string, string) {
+	meta.ClientName = strings.TrimSpace(meta.ClientName)
+	if len(meta.ClientName) > 255 {
+		return "invalid_client_metadata", "client_name is too long"
+	}
+
+	if meta.TokenEndpointAuthMethod == "" {
+		meta.TokenEndpointAuthMethod = "client_secret_basic"
+	}
+	if !slices.Contains(supportedClientAuthMethods, meta.TokenEndpointAuthMethod) {
+		return "invalid_client_metadata", "Unsupported token_endpoint_auth_method"
+	}
+
+	if len(meta.GrantTypes) == 0 {
+		meta.GrantTypes = []string{"authorization_code", "refresh_token"}
+	}
+	var grants []string
+	for _, g := range meta.GrantTypes {
+		if !slices.Contains(supportedGrantTypes, g) {
+			return "invalid_client_metadata", "Unsupported grant type: " + g
+		}
+		if !slices.Contains(grants, g) {
+			grants = append(grants, g)
+		}
+	}
+	meta.GrantTypes = grants
+	if slices.Contains(grants, "client_credentials") && meta.TokenEndpointAuthMethod == "none" {
+		return "invalid_client_metadata", "client_credentials requires a confidential client"
+	}
+
+	if len(meta.ResponseTypes) == 0 {
+		meta.ResponseTypes = []string{"code"}
+	}
+	for _, rt := range meta.ResponseTypes {
+		if rt != "code" {
+			return "invalid_client_metadata", "Unsupported response type: " + rt
+		}
+	}
+
+	var uris []string
+	for _, raw := range meta.RedirectURIs {
+		raw = strings.TrimSpace(raw)
+		if _, err := utils.ClassifyRedirectURI(raw); err != nil {
+			return "invalid_redirect_uri", "Invalid redirect URI " + raw + ": " + err.Error()
+		}
+		if !slices.Contains(uris, raw) {
+			uris = append(uris, raw)
+		}
+	}
+	meta.RedirectURIs = uris
+	if len(uris) == 0 && slices.Contains(grants, "authorization_code") {
+		return "invalid_redirect_uri", "redirect_uris is required for the authorization_code grant"
+	}
+
+	if meta.BackchannelLogoutURI != "" {
+		if msg := validateBackchannelLogoutURI(meta.BackchannelLogoutURI); msg != "" {
+			return "invalid_client_metadata", msg
+		}
+	}
+
+	if string(meta.JWKS) == "null" {
+		meta.JWKS = nil
+	}
+	meta.TLSClientCertThumbprint = ""
+	if len(meta.JWKS) > 0 {
+		set, err := utils.ParseClientJWKS(string(meta.JWKS))
+		if err != nil {
+			return "invalid_client_metadata", err.Error()
+		}
+		// A self-signed certificate is registered as the x5c of a key (RFC 8705 section 2.2)
+		if meta.TokenEndpointAuthMethod == "self_signed_tls_client_auth" {
+			for _, k := range set.Keys {
+				if len(k.Certificates) > 0 {
+					meta.TLSClientCertThumbprint = utils.CertThumbprint(k.Certificates[0])
+					break
+				}
+			}
+			if meta.TLSClientCertThumbprint == "" {
+				return "invalid_client_metadata", "self_signed_tls_client_auth needs a certificate in jwks"
+			}
+		}
+	} else if meta.RequireSignedRequest {
+		return "invalid_client_metadata", "require_signed_request_object needs jwks"
+	} else if meta.TokenEndpointAuthMethod == "private_key_jwt" {
+		return "invalid_client_metadata", "private_key_jwt needs jwks"
+	} else if meta.TokenEndpointAuthMethod == "self_signed_tls_client_auth" {
+		return "invalid_client_metadata", "self_signed_tls_client_auth needs a certificate in jwks"
+	}
+
+	meta.TLSClientAuthSubjectDN = strings.TrimSpace(meta.TLSClientAuthSubjectDN)
+	if len(meta.TLSClientAuthSubjectDN) > 512 {
+		return "invalid_client_metadata", "tls_client_auth_subject_dn is too long"
+	}
+	if meta.TokenEndpointAuthMethod == "tls_client_auth" && meta.TLSClientAuthSubjectDN == "" {
+		return "invalid_client_metadata", "tls_client_auth needs tls_client_auth_subject_dn"
+	}
+	return "", ""
+}
+
+// RegisterClientHandler implements RFC 7591 dynamic client registration. Callers present an
+// initial access token minted by a system admin or app root.
+func RegisterClientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeRegistrationError(w, http.StatusMethodNotAllowed, "invalid_request", "Use POST")
+		return
+	}
+
+	initialToken := bearerToken(r)
+	if _, err := db.GetInitialAccessTokenOwner(initialToken); err != nil {
+		if !errors.Is(err, db.ErrInvalidInitialAccessToken) {
+			log.Println("Error checking initial access token:", err)
+		}
+		writeRegistrationError(w, http.StatusUnauthorized, "invalid_token", "A valid initial access token is required")
+		return
+	}
+
+	var meta types.ClientMetadata
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		writeRegistrationError(w, http.StatusBadRequest, "invalid_client_metadata", "Invalid JSON body")
+		return
+	}
+	if code, desc := validateClientMetadata(&meta); code != "" {
+		writeRegistrationError(w, http.StatusBadRequest, code, desc)
+		return
+	}
+
+	info, err := db.RegisterClient(initialToken, meta)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrInvalidInitialAccessToken):
+			writeRegistrationError(w, http.StatusUnauthorized, "invalid_token", "A valid initial access token is required")
+		case strings.Contains(err.Error(), "Duplicate entry"):
+			writeRegistrationError(w, http.StatusBadRequest, "invalid_client_metadata", "client_name is already in use")
+		default:
+			log.Println("Error registering client:", err)
+			writeRegistrationError(w, http.StatusInternalServerError, "server_error", "Could not register client")
+		}
+		return
+	}
+
+	info.RegistrationClientURI = registrationClientURI(info.ClientID)
+	writeClientInformation(w, http.StatusCreated, info)
+}
+
+// ClientConfigurationHandler implements the RFC 7592 read, update and delete operations on
+// /oauth2/register/{client_id}, authorized by the client's registration access token.
+func ClientConfigurationHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := strings.TrimPrefix(r.URL.Path, registrationPath+"/")
+	if clientID == "" || clientID == "system" || !db.ValidateRegistrationToken(clientID, bearerToken(r)) {
+		writeRegistrationError(w, http.StatusUnauthorized, "invalid_token", "Invalid registration access token")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		info, err := clientInformation(clientID)
+		if err != nil {
+			log.Println("Error reading registered client:", err)
+			writeRegistrationError(w, http.StatusInternalServerError, "server_error", "Could not read client")
+			return
+		}
+		writeClientInformation(w, http.StatusOK, info)
+
+	case http.MethodPut:
+		var body struct {
+			ClientID string `json:"client_id"`
+			types.ClientMetadata
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeRegistrationError(w, http.StatusBadRequest, "invalid_client_metadata", "Invalid JSON body")
+			return
+		}
+		if body.ClientID != clientID {
+			writeRegistrationError(w, http.StatusBadRequest, "invalid_client_metadata", "client_id does not match")
+			return
+		}
+		meta := body.ClientMetadata
+		if code, desc := validateClientMetadata(&meta); code != "" {
+			writeRegistrationError(w, http.StatusBadRequest, code, desc)
+			return
+		}
+
+		secret, err := db.UpdateRegisteredClient(clientID, meta)
+		if err != nil {
+			if strings.Contains(err.Error(), "Duplicate entry") {
+				writeRegistrationError(w, http.StatusBadRequest, "invalid_client_metadata", "client_name is already in use")
+				return
+			}
+			log.Println("Error updating registered client:", err)
+			writeRegistrationError(w, http.StatusInternalServerError, "server_error", "Could not update client")
+			return
+		}
+
+		info, err := clientInformation(clientID)
+		if err != nil {
+			log.Println("Error reading registered client:", err)
+			writeRegistrationError(w, http.StatusInternalServerError, "server_error", "Could not read client")
+			return
+		}
+		info.TokenEndpointAuthMethod = meta.TokenEndpointAuthMethod
+		if secret != "" {
+			var never int64
+			info.ClientSecret = secret
+			info.ClientSecretExpiresAt = &never
+		}
+		writeClientInformation(w, http.StatusOK, info)
+
+	case http.MethodDelete:
+		if err := db.DeleteApp(clientID); err != nil {
+			log.Println("Error deleting registered client:", err)
+			writeRegistrationError(w, http.StatusInternalServerError, "server_error", "Could not delete client")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeRegistrationError(w, http.StatusMethodNotAllowed, "invalid_request", "Use GET, PUT or DELETE")
+	}
+}
+
+// clientInformation describes a registered client from its current app settings. The
+// secret and registration access token are stored hashed and cannot be returned again.
+func clientInformation(clientID string) (*types.ClientInformation, error) {
+	app, err := db.GetApplication(clientID)
+	if err != nil {
+		return nil, err
+	}
+	uris, err := db.GetTrustedURIs(clientID)
+	if err != nil {
+		return nil, err
+	}
+	hasSecret, err := db.HasAppSecrets(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &types.ClientInformation{
+		ClientID:              clientID,
+		RegistrationClientURI: registrationClientURI(clientID),
+		ClientMetadata: types.ClientMetadata{
+			ClientName:              app.Name,
+			RedirectURIs:            []string{},
+			GrantTypes:              app.Policy.AllowedGrantTypes,
+			ResponseTypes:           []string{"code"},
+			TokenEndpointAuthMethod: "none",
+			BackchannelLogoutURI:    app.BackchannelLogoutURI,
+			RequirePAR:              app.Policy.RequirePAR,
+			RequireSignedRequest:    app.Policy.RequireSignedRequest,
+			TLSClientAuthSubjectDN:  app.TLSClientSubjectDN,
+		},
+	}
+	if app.JWKS != "" {
+		info.JWKS = json.RawMessage(app.JWKS)
+	}
+	if t, err := time.Parse(time.RFC3339, app.CreatedAt); err == nil {
+		info.ClientIDIssuedAt = t.Unix()
+	}
+	for _, u := range uris {
+		info.RedirectURIs = append(info.RedirectURIs, u.URI)
+	}
+	switch {
+	case app.TokenEndpointAuthMethod != "":
+		info.TokenEndpointAuthMethod = app.TokenEndpointAuthMethod
+	case hasSecret:
+		info.TokenEndpointAuthMethod = "client_secret_basic"
+	}
+	return info, nil
+}
+
+func ListInitialAccessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	tokens, err := db.ListInitialAccessTokens(claims.Username)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Could not fetch registration tokens")
+		return
+	}
+	WriteSuccessResponse(w, "Registration tokens", tokens)
+}
+
+func CreateInitialAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.CreateInitialAccessTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	allowed, err := db.CanMintInitialAccessTokens(claims.Username)
+	if err != nil || !allowed {
+		WriteErrorResponse(w, http.StatusForbidden, "Only system admins and app roots can create registration tokens")
+		return
+	}
+
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = 30
+	}
+	if req.ExpiresInDays < 1 || req.ExpiresInDays > 365 {
+		WriteErrorResponse(w, http.StatusBadRequest, "expiresInDays must be between 1 and 365")
+		return
+	}
+	if req.MaxUses != nil && *req.MaxUses < 1 {
+		WriteErrorResponse(w, http.StatusBadRequest, "maxUses must be at least 1")
+		return
+	}
+
+	expiresAt := time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+	token, err := db.CreateInitialAccessToken(claims.Username, strings.TrimSpace(req.Name), req.MaxUses, expiresAt)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Could not create registration token")
+		return
+	}
+	WriteSuccessResponse(w, "Registration token created", token)
+}
+
+func RevokeInitialAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := db.RevokeInitialAccessToken(req.ID, claims.Username); err != nil {
+		WriteErrorResponse(w, http.StatusNotFound, "Registration token not found")
+		return
+	}
+	WriteSuccessResponse(w, "Registration token revoked", nil)
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mirpass-backend/db"
+	"mirpass-backend/types"
+	"mirpass-backend/utils"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var errInvalidTarget = errors.New("invalid_target")
+
+var resourceScopePattern = regexp.MustCompile(`^[A-Za-z0-9_.:/-]{1,64}$`)
+
+// validResourceIdentifier checks an RFC 8707 resource indicator: an absolute URI without a fragment.
+func validResourceIdentifier(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.IsAbs() && !strings.Contains(raw, "#") && !strings.ContainsAny(raw, " \t") && len(raw) <= 255
+}
+
+// lookupResources resolves the resource parameters of a request. It fails with
+// errInvalidTarget when one of them is not a registered resource.
+func lookupResources(identifiers []string) ([]types.APIResource, error) {
+	var unique []string
+	for _, id := range identifiers {
+		if !slices.Contains(unique, id) {
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) == 0 {
+		return nil, nil
+	}
+	resources, err := db.GetAPIResourcesByIdentifier(unique)
+	if err != nil {
+		return nil, err
+	}
+	if len(resources) != len(unique) {
+		return nil, errInvalidTarget
+	}
+	return resources, nil
+}
+
+func resourceScopes(resources []types.APIResource) []string {
+	var scopes []string
+	for _, res := range resources {
+		for _, s := range res.Scopes {
+			if !slices.Contains(scopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return scopes
+}
+
+// tokenAudience picks the audience of an access token from the resources granted at
+// authorization: those named by the token request's resource parameters, or all of them.
+// The scope is trimmed to the standard scopes plus those of the chosen resources.
+func tokenAudience(r *http.Request, granted []string, scope string) ([]string, string, error) {
+	chosen := granted
+	if requested := r.Form["resource"]; len(requested) > 0 {
+		chosen = nil
+		for _, id := range requested {
+			if !slices.Contains(granted, id) {
+				return nil, "", errInvalidTarget
+			}
+			if !slices.Contains(chosen, id) {
+				chosen = append(chosen, id)
+			}
+		}
+	}
+	if len(chosen) == 0 {
+		return nil, scope, nil
+	}
+
+	resources, err := db.GetAPIResourcesByIdentifier(chosen)
+	if err != nil {
+		return nil, "", err
+	}
+	// A resource deleted since authorization can no longer be a token audience
+	if len(resources) != len(chosen) {
+		return nil, "", errInvalidTarget
+	}
+	allowed := append(slices.Clone(utils.SupportedScopes), resourceScopes(resources)...)
+	var kept []string
+	for _, s := range strings.Fields(scope) {
+		if slices.Contains(allowed, s) {
+			kept = append(kept, s)
+		}
+	}
+	return chosen, strings.Join(kept, " "), nil
+}
+
+// writeTokenAudienceError reports a failed tokenAudience.
+func writeTokenAudienceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInvalidTarget) {
+		WriteOauthErrorResponse(w, "invalid_target", "The resource was not granted or is no longer registered")
+		return
+	}
+	log.Println("Error resolving token audience:", err)
+	WriteOauthErrorResponse(w, "server_error", "Failed to process request")
+}
+
+// validateAPIResource checks the name and scopes of a resource and deduplicates the scopes.
+func validateAPIResource(req *types.APIResourceRequest) string {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 255 {
+		return "Name is required and must be at most 255 characters"
+	}
+	var scopes []string
+	for _, s := range req.Scopes {
+		if !resourceScopePattern.MatchString(s) {
+			return "Invalid scope: " + s
+		}
+		if slices.Contains(utils.SupportedScopes, s) {
+			return "Scope " + s + " is reserved"
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) > 32 {
+		return "At most 32 scopes are allowed"
+	}
+	if scopes == nil {
+		scopes = []string{}
+	}
+	req.Scopes = scopes
+	return ""
+}
+
+func ListAPIResourcesHandler(w http.ResponseWriter, r *http.Request) {
+	appID := r.URL.Query().Get("id")
+	if appID == "" {
+		WriteErrorResponse(w, http.StatusBadRequest, "App ID is required")
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	isAdmin, err := db.IsAppAdmin(claims.Username, appID)
+	if err != nil || !isAdmin {
+		WriteErrorResponse(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	resources, err := db.ListAPIResources(appID)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Could not fetch API resources")
+		return
+	}
+
+	WriteSuccessResponse(w, "API resources", resources)
+}
+
+func CreateAPIResourceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.APIResourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	isAdmin, err := db.IsAppAdmin(claims.Username, req.AppID)
+	if err != nil || !isAdmin {
+		WriteErrorResponse(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	req.Identifier = strings.TrimSpace(req.Identifier)
+	if !validResourceIdentifier(req.Identifier) {
+		WriteErrorResponse(w, http.StatusBadRequest, "Identifier must be an absolute URI without a fragment")
+		return
+	}
+	if msg := validateAPIResource(&req); msg != "" {
+		WriteErrorResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	res, err := db.CreateAPIResource(req.AppID, req.Identifier, req.Name, req.Scopes)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			WriteErrorResponse(w, http.StatusBadRequest, "Identifier is already registered")
+			return
+		}
+		WriteErrorResponse(w, http.StatusInternalServerError, "Could not create API resource")
+		return
+	}
+
+	WriteSuccessResponse(w, "API resource created", res)
+}
+
+func UpdateAPIResourceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.APIResourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	isAdmin, err := db.IsAppAdmin(claims.Username, req.AppID)
+	if err != nil || !isAdmin {
+		WriteErrorResponse(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	if msg := validateAPIResource(&req); msg != "" {
+		WriteErrorResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err := db.UpdateAPIResource(req.AppID, req.ResourceID, req.Name, req.Scopes); err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Could not update API resource")
+		return
+	}
+
+	WriteSuccessResponse(w, "API resource updated", nil)
+}
+
+func DeleteAPIResourceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.APIResourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	claims, err := utils.ExtractClaims(r)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	isAdmin, err := db.IsAppAdmin(claims.Username, req.AppID)
+	if err != nil || !isAdmin {
+		WriteErrorResponse(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	if err := db.DeleteAPIResource(req.AppID, req.ResourceID); err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, "Could not delete API resource")
+		return
+	}
+
+	WriteSuccessResponse(w, "API resource deleted", nil)
+}
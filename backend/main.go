@@ -12,8 +12,19 @@ import (
 
 func main() {
 	config.LoadConfig()
-	utils.InitKeys()
 	db.ConnectDB()
+	utils.IsTokenRevoked = db.IsTokenRevoked
+	if err := db.InitSigningKeys(); err != nil {
+		log.Fatal("Error loading signing keys: ", err)
+	}
+	if err := utils.InitMTLS(); err != nil {
+		log.Fatal("Error loading mutual-TLS settings: ", err)
+	}
+	if err := utils.InitTrustedProxies(); err != nil {
+		log.Fatal("Error loading trusted proxies: ", err)
+	}
+	go db.RunSigningKeyMaintenance()
+	go handlers.RunBackchannelLogoutWorker()
 	mux := http.NewServeMux()
 
 	// Health check endpoint
@@ -55,11 +66,14 @@ func main() {
 	mux.Handle("/admin/apps", handlers.AuthSysMiddleware(handlers.RequireAdmin("system", http.HandlerFunc(handlers.AdminListApps))))
 	mux.Handle("/admin/app/delete", handlers.AuthSysMiddleware(handlers.RequireAdmin("system", http.HandlerFunc(handlers.AdminDeleteApp))))
 	mux.Handle("/admin/app/suspend", handlers.AuthSysMiddleware(handlers.RequireAdmin("system", http.HandlerFunc(handlers.AdminSuspendApp))))
+	mux.Handle("/admin/app/first-party", handlers.AuthSysMiddleware(handlers.RequireAdmin("system", http.HandlerFunc(handlers.AdminSetFirstParty))))
 
 	// My Apps endpoint
 	mux.Handle("/myapps", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.MyAppsHandler)))
 	mux.Handle("/user/history", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.GetLoginHistoryHandler)))
 	mux.Handle("/user/apps/summary", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.GetUserAppsSummaryHandler)))
+	mux.Handle("/user/apps/connected", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.ListConnectedAppsHandler)))
+	mux.Handle("/user/apps/connected/revoke", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.RevokeConnectedAppHandler)))
 
 	// App Management
 	mux.Handle("/apps/create", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.CreateAppHandler)))
@@ -75,8 +89,23 @@ func main() {
 	mux.Handle("/apps/update", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.UpdateAppHandler)))
 	mux.Handle("/apps/delete", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.DeleteAppHandler)))
 	mux.Handle("/apps/device-code/toggle", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.UpdateDeviceCodeEnabledHandler)))
+	mux.Handle("/apps/tls-client-auth", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.UpdateAppTLSClientAuthHandler)))
 	mux.Handle("/apps/stats", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.GetAppStatsHandler)))
 	mux.Handle("/apps/history", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.GetAppHistoryHandler)))
+	mux.Handle("/apps/backchannel/deliveries", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.GetBackchannelDeliveriesHandler)))
+
+	mux.Handle("/apps/registration-tokens", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.ListInitialAccessTokensHandler)))
+	mux.Handle("/apps/registration-tokens/create", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.CreateInitialAccessTokenHandler)))
+	mux.Handle("/apps/registration-tokens/revoke", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.RevokeInitialAccessTokenHandler)))
+
+	mux.Handle("/apps/resources", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.ListAPIResourcesHandler)))
+	mux.Handle("/apps/resources/create", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.CreateAPIResourceHandler)))
+	mux.Handle("/apps/resources/update", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.UpdateAPIResourceHandler)))
+	mux.Handle("/apps/resources/delete", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.DeleteAPIResourceHandler)))
+
+	mux.Handle("/apps/token-exchange", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.GetTokenExchangeRulesHandler)))
+	mux.Handle("/apps/token-exchange/add", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.AddTokenExchangeRuleHandler)))
+	mux.Handle("/apps/token-exchange/remove", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.RemoveTokenExchangeRuleHandler)))
 
 	mux.Handle("/apps/members", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.GetAppMembersHandler)))
 	mux.Handle("/apps/members/add", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.AddAppMemberHandler)))
@@ -91,10 +120,24 @@ func main() {
 	// OAuth2 Device Code Flow Routes
 	mux.HandleFunc("/oauth2/devicecode", handlers.DeviceFlowInitiateHandler)
 	mux.HandleFunc("/oauth2/token", handlers.GetTokenHandler)
+	mux.HandleFunc("/oauth2/revoke", handlers.RevokeTokenHandler)
+	mux.HandleFunc("/oauth2/introspect", handlers.IntrospectTokenHandler)
+
+	// Dynamic Client Registration
+	mux.HandleFunc("/oauth2/register", handlers.RegisterClientHandler)
+	mux.HandleFunc("/oauth2/register/", handlers.ClientConfigurationHandler)
+
+	// Logout
+	mux.HandleFunc("/oauth2/logout", handlers.EndSessionHandler)
+	mux.HandleFunc("/oauth2/logout/request", handlers.LogoutRequestDetailsHandler)
+	mux.HandleFunc("/oauth2/logout/confirm", handlers.LogoutConfirmHandler)
+	mux.Handle("/logout", handlers.AuthSysMiddleware(http.HandlerFunc(handlers.LogoutHandler)))
 
 	// Auth Code Flow Consent Handler
 	mux.HandleFunc("/oauth2/authorize", handlers.AuthCodeFlowHandler)
+	mux.HandleFunc("/oauth2/par", handlers.PushedAuthorizationHandler)
 	mux.HandleFunc("/authorize/consent/redirect", handlers.AuthCodeFlowConsentHandler)
+	mux.HandleFunc("/authorize/consent/silent", handlers.AuthCodeSilentHandler)
 
 	// OIDC Discovery
 	mux.HandleFunc("/.well-known/openid-configuration", handlers.OIDCConfigurationHandler)
@@ -103,8 +146,26 @@ func main() {
 	// Root routes
 	mux.Handle("/root/user/role", handlers.AuthSysMiddleware(handlers.RequireRoot("system", http.HandlerFunc(handlers.RootUpdateRole))))
 	mux.Handle("/root/sql", handlers.AuthSysMiddleware(handlers.RequireRoot("system", http.HandlerFunc(handlers.RootDirectSQL))))
+	mux.Handle("/root/keys", handlers.AuthSysMiddleware(handlers.RequireRoot("system", http.HandlerFunc(handlers.RootListSigningKeys))))
+	mux.Handle("/root/keys/rotate", handlers.AuthSysMiddleware(handlers.RequireRoot("system", http.HandlerFunc(handlers.RootRotateSigningKey))))
+	mux.Handle("/root/keys/retire", handlers.AuthSysMiddleware(handlers.RequireRoot("system", http.HandlerFunc(handlers.RootRetireSigningKey))))
 
 	// Wrap the mux with the CORS middleware
+	handler := handlers.CORSMiddleware(mux)
+
+	// The TLS listener asks for client certificates, for mutual-TLS client authentication
+	if config.AppConfig.TLSCertFile != "" {
+		tlsServer := &http.Server{
+			Addr:      ":" + strconv.Itoa(config.AppConfig.TLSPort),
+			Handler:   handler,
+			TLSConfig: utils.ServerTLSConfig(),
+		}
+		go func() {
+			log.Println("TLS server starting on port " + strconv.Itoa(config.AppConfig.TLSPort))
+			log.Println(tlsServer.ListenAndServeTLS(config.AppConfig.TLSCertFile, config.AppConfig.TLSKeyFile))
+		}()
+	}
+
 	log.Println("Server starting on port " + strconv.Itoa(config.AppConfig.Port))
-	log.Println(http.ListenAndServe(":"+strconv.Itoa(config.AppConfig.Port), handlers.CORSMiddleware(mux)))
+	log.Println(http.ListenAndServe(":"+strconv.Itoa(config.AppConfig.Port), handler))
 }
@@ -6,9 +6,15 @@ type DeviceFlowSession struct {
 	Username   string
 	DeviceCode string
 	UserCode   string
+	Scope      string
+	AuthTime   string
 	Status     string
 	ExpiresAt  string
 	LastPoll   string
+	// PollInterval is the device's current minimum poll interval in seconds, 0 for the app's default
+	PollInterval    int
+	DeviceIP        string
+	DeviceUserAgent string
 }
 
 type AuthCodeFlowSession struct {
@@ -19,8 +25,16 @@ type AuthCodeFlowSession struct {
 	CodeChallenge       string
 	CodeChallengeMethod string
 	State               string
+	Scope               string
+	Nonce               string
+	Prompt              string
+	MaxAge              *int
+	LoginHint           string
+	Resources           []string
+	AuthTime            string
 	Status              string
 	ExpiresAt           string
+	CreatedAt           string
 }
 
 type OAuthSession struct {
@@ -28,6 +42,39 @@ type OAuthSession struct {
 	ClientID  string
 	Username  string
 	FlowType  string
+	Scope     string
+	Prompt    string
+	MaxAge    *int
+	LoginHint string
+	Resources []string
+	AuthTime  string
 	Status    string
 	ExpiresAt string
+	CreatedAt string
+	// Set for device flow sessions, shown on the consent screen
+	DeviceIP        string
+	DeviceUserAgent string
+}
+
+type RefreshToken struct {
+	ID           int64
+	TokenHash    string
+	FamilyID     string
+	SessionID    string
+	ClientID     string
+	Username     string
+	Status       string
+	Confidential bool
+	DPoPJKT      string // set when bound to a public client's DPoP key
+	ExpiresAt    string
+}
+
+type LogoutRequest struct {
+	LogoutID    string
+	ClientID    string
+	Username    string
+	RedirectURI string
+	State       string
+	Status      string
+	ExpiresAt   string
 }
@@ -1,15 +1,28 @@
 package types
 
+import "encoding/json"
+
 type CreateAppRequest struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
 }
 
+type CreateInitialAccessTokenRequest struct {
+	Name          string `json:"name"`
+	ExpiresInDays int    `json:"expiresInDays"`
+	MaxUses       *int   `json:"maxUses"`
+}
+
 type UpdateAppRequest struct {
-	AppID       string `json:"appId"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	LogoURL     string `json:"logoUrl,omitempty"`
+	AppID       string          `json:"appId"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	LogoURL     string          `json:"logoUrl,omitempty"`
+	Policy      json.RawMessage `json:"policy,omitempty"` // fields present replace the current policy values
+	// BackchannelLogoutURI is left unchanged when omitted; an empty string clears it
+	BackchannelLogoutURI *string `json:"backchannelLogoutUri,omitempty"`
+	// JWKS is the app's public key set as a JSON document, with the same rules
+	JWKS *string `json:"jwks,omitempty"`
 }
 
 type AddMemberRequest struct {
@@ -33,6 +46,22 @@ type AddTrustedURIRequest struct {
 	AppID string `json:"appId"`
 	Name  string `json:"name"`
 	URI   string `json:"uri"`
+	// Kind is optional; when set it must match the kind of URI
+	Kind string `json:"kind"`
+}
+
+type APIResourceRequest struct {
+	AppID      string   `json:"appId"`
+	ResourceID string   `json:"resourceId"`
+	Identifier string   `json:"identifier"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+}
+
+// TokenExchangeRuleRequest lets ClientID exchange user tokens for tokens addressed to AppID.
+type TokenExchangeRuleRequest struct {
+	AppID    string `json:"appId"`
+	ClientID string `json:"clientId"`
 }
 
 type DeleteTrustedURIRequest struct {
@@ -47,4 +76,11 @@ type AuthCodeFlowRequest struct {
 	CodeChallenge       string `json:"code_challenge"`
 	CodeChallengeMethod string `json:"code_challenge_method"`
 	State               string `json:"state"`
+	Scope               string `json:"scope"`
+	Nonce               string `json:"nonce"`
+	Prompt              string `json:"prompt"`
+	MaxAge              *int   `json:"max_age"`
+	LoginHint           string `json:"login_hint"`
+	// Resources are the API identifiers requested with the resource parameter
+	Resources []string `json:"resource"`
 }
@@ -1,5 +1,7 @@
 package types
 
+import "encoding/json"
+
 type Response struct {
 	Status  int         `json:"status"`
 	Message string      `json:"message,omitempty"`
@@ -60,8 +62,38 @@ type Application struct {
 	LogoURL           string  `json:"logoUrl,omitempty"`
 	SuspendUntil      *string `json:"suspendUntil,omitempty"`
 	DeviceCodeEnabled bool    `json:"deviceCodeEnabled"`
-	CreatedAt         string  `json:"createdAt"`
-	Role              string  `json:"role,omitempty"`
+	// FirstParty apps are trusted by the operator, so users are never asked for consent
+	FirstParty           bool      `json:"firstParty"`
+	Policy               AppPolicy `json:"policy"`
+	BackchannelLogoutURI string    `json:"backchannelLogoutUri,omitempty"`
+	JWKS                 string    `json:"jwks,omitempty"`
+	// TokenEndpointAuthMethod is only set for dynamically registered clients
+	TokenEndpointAuthMethod string `json:"tokenEndpointAuthMethod,omitempty"`
+	// Mutual-TLS client authentication: a pinned certificate thumbprint (x5t#S256) or a subject DN
+	TLSClientCertThumbprint string `json:"tlsClientCertThumbprint,omitempty"`
+	TLSClientSubjectDN      string `json:"tlsClientSubjectDn,omitempty"`
+	CreatedAt               string `json:"createdAt"`
+	Role                    string `json:"role,omitempty"`
+}
+
+// AppPolicy controls how the OAuth endpoints treat an application.
+// Lifetimes and the poll interval are in seconds.
+type AppPolicy struct {
+	AccessTokenLifetime  int      `json:"accessTokenLifetime"`
+	IDTokenLifetime      int      `json:"idTokenLifetime"`
+	RefreshTokenLifetime int      `json:"refreshTokenLifetime"`
+	AllowedGrantTypes    []string `json:"allowedGrantTypes"`
+	RequirePKCE          bool     `json:"requirePkce"`
+	AllowPlainPKCE       bool     `json:"allowPlainPkce"`
+	DeviceCodeLifetime   int      `json:"deviceCodeLifetime"`
+	DevicePollInterval   int      `json:"devicePollInterval"`
+	RequirePAR           bool     `json:"requirePar"`
+	RequireSignedRequest bool     `json:"requireSignedRequest"`
+	// OAuth21Strict overrides the server's OAuth 2.1 strict mode; nil follows the server
+	OAuth21Strict *bool `json:"oauth21Strict"`
+	// Device flow user codes: length in characters and a name from utils.UserCodeAlphabets
+	UserCodeLength   int    `json:"userCodeLength"`
+	UserCodeAlphabet string `json:"userCodeAlphabet"`
 }
 
 type AppSecret struct {
@@ -79,6 +111,47 @@ type CreateSecretResponse struct {
 	CreatedAt string `json:"createdAt"`
 }
 
+// InitialAccessToken authorizes client registration through /oauth2/register.
+type InitialAccessToken struct {
+	ID         int64  `json:"id"`
+	Token      string `json:"token,omitempty"` // Returned only once
+	Name       string `json:"name,omitempty"`
+	CreatedBy  string `json:"createdBy"`
+	MaxUses    *int   `json:"maxUses,omitempty"`
+	Uses       int    `json:"uses"`
+	Status     string `json:"status"`
+	ExpiresAt  string `json:"expiresAt"`
+	LastUsedAt string `json:"lastUsedAt,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+// ClientMetadata is the RFC 7591 client metadata MirPass understands. Other fields are ignored.
+type ClientMetadata struct {
+	ClientName              string          `json:"client_name,omitempty"`
+	RedirectURIs            []string        `json:"redirect_uris"`
+	GrantTypes              []string        `json:"grant_types"`
+	ResponseTypes           []string        `json:"response_types"`
+	TokenEndpointAuthMethod string          `json:"token_endpoint_auth_method"`
+	BackchannelLogoutURI    string          `json:"backchannel_logout_uri,omitempty"`
+	RequirePAR              bool            `json:"require_pushed_authorization_requests"`
+	RequireSignedRequest    bool            `json:"require_signed_request_object"`
+	JWKS                    json.RawMessage `json:"jwks,omitempty"`
+	TLSClientAuthSubjectDN  string          `json:"tls_client_auth_subject_dn,omitempty"`
+	// TLSClientCertThumbprint is taken from the jwks certificate of a self_signed_tls_client_auth client
+	TLSClientCertThumbprint string `json:"-"`
+}
+
+// ClientInformation is the response of the registration endpoints (RFC 7591 section 3.2.1, RFC 7592 section 3).
+type ClientInformation struct {
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   *int64 `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+	ClientMetadata
+}
+
 type APIKey struct {
 	ID        int64  `json:"id"`
 	AppID     string `json:"appId"`
@@ -91,9 +164,31 @@ type TrustedURI struct {
 	AppID     string `json:"appId"`
 	Name      string `json:"name,omitempty"`
 	URI       string `json:"uri"`
+	Kind      string `json:"kind"` // web, loopback or custom
 	CreatedAt string `json:"createdAt"`
 }
 
+// APIResource is a resource server registered by an app. Clients name it by Identifier in
+// the resource parameter (RFC 8707) and may request its scopes.
+type APIResource struct {
+	ID         string   `json:"id"`
+	AppID      string   `json:"appId"`
+	Identifier string   `json:"identifier"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+}
+
+// TokenExchangeRule allows ClientID to exchange user tokens for tokens with Audience as their audience.
+type TokenExchangeRule struct {
+	ID         int64  `json:"id"`
+	ClientID   string `json:"clientId"`
+	ClientName string `json:"clientName"`
+	Audience   string `json:"audience"`
+	CreatedBy  string `json:"createdBy"`
+	CreatedAt  string `json:"createdAt"`
+}
+
 type AppMember struct {
 	Username  string `json:"username"`
 	Role      string `json:"role"`
@@ -118,11 +213,50 @@ type AppStatsSummary struct {
 type LoginHistoryItem struct {
 	User      string `json:"user,omitempty"`
 	App       string `json:"app,omitempty"`
+	Grant     string `json:"grant,omitempty"` // set for app-only tokens, which have no user
 	Timestamp string `json:"time"`
 }
 
 type AppLoginSummaryItem struct {
+	AppID     string `json:"appId"`
 	App       string `json:"app"`
 	LogoUrl   string `json:"logoUrl,omitempty"`
 	Timestamp string `json:"time"`
 }
+
+// ConnectedApp is an app the user has granted access to.
+type ConnectedApp struct {
+	AppID     string   `json:"appId"`
+	App       string   `json:"app"`
+	LogoUrl   string   `json:"logoUrl,omitempty"`
+	Scopes    []string `json:"scopes"`
+	GrantedAt string   `json:"grantedAt"`
+	UpdatedAt string   `json:"updatedAt"`
+	LastLogin string   `json:"lastLogin,omitempty"`
+}
+
+type SigningKey struct {
+	KeyID      string `json:"kid"`
+	Algorithm  string `json:"alg"`
+	Status     string `json:"status"`
+	Source     string `json:"source"`
+	CreatedAt  string `json:"createdAt"`
+	RotatedAt  string `json:"rotatedAt,omitempty"`
+	RetiredAt  string `json:"retiredAt,omitempty"`
+	PrivateKey string `json:"-"`
+}
+
+type BackchannelDelivery struct {
+	ID            int64  `json:"id"`
+	ClientID      string `json:"-"`
+	URI           string `json:"-"`
+	Username      string `json:"username"`
+	SID           string `json:"sid"`
+	Reason        string `json:"reason"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	LastError     string `json:"lastError,omitempty"`
+	NextAttemptAt string `json:"nextAttemptAt,omitempty"`
+	CreatedAt     string `json:"createdAt"`
+	DeliveredAt   string `json:"deliveredAt,omitempty"`
+}
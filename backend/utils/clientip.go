@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"fmt"
+	"mirpass-backend/config"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var forwardingProxies []*net.IPNet
+
+// InitTrustedProxies loads the reverse proxies whose X-Forwarded-For header is believed.
+func InitTrustedProxies() error {
+	networks, err := parseNetworks(config.AppConfig.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	forwardingProxies = networks
+	return nil
+}
+
+// parseNetworks parses a comma-separated list of IPs and CIDRs. A bare IP is a single-host network.
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ClientIP returns the IP address of the client. Behind a trusted proxy it is the address
+// the proxy appended to X-Forwarded-For; earlier entries could be forged by the client.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !inNetworks(host, forwardingProxies) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	if last := strings.TrimSpace(hops[len(hops)-1]); net.ParseIP(last) != nil {
+		return last
+	}
+	return host
+}
+
+func inNetworks(host string, networks []*net.IPNet) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mirpass-backend/config"
+	"net/url"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DPoPProofLifetime is how far a proof's iat may be from now, and how long nonces stay valid.
+const DPoPProofLifetime = 5 * time.Minute
+
+// DPoPProof is a verified DPoP proof (RFC 9449).
+type DPoPProof struct {
+	JKT      string // SHA-256 thumbprint of the proof key, as used in the cnf jkt claim
+	JTI      string
+	Nonce    string
+	IssuedAt time.Time
+}
+
+// VerifyDPoPProof checks a proof's signature against its embedded public key and that it
+// was made for this method and URI. For resource requests accessToken is the presented
+// token, which the proof must hash in ath; pass "" at the token endpoint.
+// Nonce and jti replay checks are left to the caller.
+func VerifyDPoPProof(proof, method, uri, accessToken string) (*DPoPProof, error) {
+	var key jose.JSONWebKey
+	token, err := jwt.Parse(proof, func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, errors.New("typ must be dpop+jwt")
+		}
+		raw, err := json.Marshal(t.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		if err := key.UnmarshalJSON(raw); err != nil || !key.Valid() || !key.IsPublic() {
+			return nil, errors.New("jwk header must be a public key")
+		}
+		return key.Key, nil
+	}, jwt.WithValidMethods(ClientSigningAlgs))
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, errors.New("missing jti")
+	}
+	if htm, _ := claims["htm"].(string); htm != method {
+		return nil, errors.New("htm does not match the request method")
+	}
+	htu, _ := claims["htu"].(string)
+	if u, err := url.Parse(htu); err != nil || u.Scheme+"://"+u.Host+u.Path != uri {
+		return nil, errors.New("htu does not match the request URI")
+	}
+	iat, err := claims.GetIssuedAt()
+	if err != nil || iat == nil {
+		return nil, errors.New("missing iat")
+	}
+	if age := time.Since(iat.Time); age > DPoPProofLifetime || age < -DPoPProofLifetime {
+		return nil, errors.New("proof is too old or from the future")
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if ath, _ := claims["ath"].(string); !hmac.Equal([]byte(ath), []byte(base64.RawURLEncoding.EncodeToString(sum[:]))) {
+			return nil, errors.New("ath does not match the access token")
+		}
+	}
+
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	nonce, _ := claims["nonce"].(string)
+	return &DPoPProof{
+		JKT:      base64.RawURLEncoding.EncodeToString(thumbprint),
+		JTI:      jti,
+		Nonce:    nonce,
+		IssuedAt: iat.Time,
+	}, nil
+}
+
+// DPoPNonce returns the current server nonce. Nonces are derived from the time window, so
+// every replica hands out and accepts the same ones without shared state.
+func DPoPNonce() string {
+	return dpopNonceAt(time.Now().Unix() / int64(DPoPProofLifetime.Seconds()))
+}
+
+// ValidDPoPNonce accepts the nonce of the current or the previous window.
+func ValidDPoPNonce(nonce string) bool {
+	slot := time.Now().Unix() / int64(DPoPProofLifetime.Seconds())
+	return hmac.Equal([]byte(nonce), []byte(dpopNonceAt(slot))) || hmac.Equal([]byte(nonce), []byte(dpopNonceAt(slot-1)))
+}
+
+func dpopNonceAt(slot int64) string {
+	mac := hmac.New(sha256.New, []byte(config.AppConfig.JWTSecret))
+	fmt.Fprintf(mac, "dpop-nonce:%d", slot)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+}
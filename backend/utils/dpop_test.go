@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	dpopTestMethod = "POST"
+	dpopTestURI    = "https://auth.example.com/oauth2/token"
+	dpopTestToken  = "access-token"
+)
+
+func signDPoPProof(t *testing.T, key *ecdsa.PrivateKey, typ string, jwk jose.JSONWebKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = typ
+	token.Header["jwk"] = jwk
+	proof, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing proof: %v", err)
+	}
+	return proof
+}
+
+func TestVerifyDPoPProof(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	public := jose.JSONWebKey{Key: &key.PublicKey}
+	sum := sha256.Sum256([]byte(dpopTestToken))
+	ath := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// claims returns valid proof claims with the given changes; a nil value removes the claim
+	claims := func(changes map[string]interface{}) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"jti": GenerateID(),
+			"htm": dpopTestMethod,
+			"htu": dpopTestURI,
+			"iat": time.Now().Unix(),
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name        string
+		typ         string
+		jwk         jose.JSONWebKey
+		claims      jwt.MapClaims
+		accessToken string
+		wantErr     bool
+	}{
+		{"valid", "dpop+jwt", public, claims(nil), "", false},
+		{"valid with ath", "dpop+jwt", public, claims(map[string]interface{}{"ath": ath}), dpopTestToken, false},
+		{"htu query and fragment ignored", "dpop+jwt", public, claims(map[string]interface{}{"htu": dpopTestURI + "?a=1#b"}), "", false},
+		{"wrong typ", "jwt", public, claims(nil), "", true},
+		{"private jwk", "dpop+jwt", jose.JSONWebKey{Key: key}, claims(nil), "", true},
+		{"missing jti", "dpop+jwt", public, claims(map[string]interface{}{"jti": nil}), "", true},
+		{"wrong htm", "dpop+jwt", public, claims(map[string]interface{}{"htm": "GET"}), "", true},
+		{"lowercase htm", "dpop+jwt", public, claims(map[string]interface{}{"htm": "post"}), "", true},
+		{"wrong htu host", "dpop+jwt", public, claims(map[string]interface{}{"htu": "https://evil.example.com/oauth2/token"}), "", true},
+		{"wrong htu path", "dpop+jwt", public, claims(map[string]interface{}{"htu": "https://auth.example.com/userinfo"}), "", true},
+		{"wrong htu scheme", "dpop+jwt", public, claims(map[string]interface{}{"htu": "http://auth.example.com/oauth2/token"}), "", true},
+		{"missing iat", "dpop+jwt", public, claims(map[string]interface{}{"iat": nil}), "", true},
+		{"iat too old", "dpop+jwt", public, claims(map[string]interface{}{"iat": time.Now().Add(-2 * DPoPProofLifetime).Unix()}), "", true},
+		{"iat in the future", "dpop+jwt", public, claims(map[string]interface{}{"iat": time.Now().Add(2 * DPoPProofLifetime).Unix()}), "", true},
+		{"missing ath", "dpop+jwt", public, claims(nil), dpopTestToken, true},
+		{"ath of another token", "dpop+jwt", public, claims(map[string]interface{}{"ath": ath}), "other-token", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proof := signDPoPProof(t, key, tt.typ, tt.jwk, tt.claims)
+			got, err := VerifyDPoPProof(proof, dpopTestMethod, dpopTestURI, tt.accessToken)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyDPoPProof() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			thumbprint, err := public.Thumbprint(crypto.SHA256)
+			if err != nil {
+				t.Fatalf("thumbprint: %v", err)
+			}
+			if want := base64.RawURLEncoding.EncodeToString(thumbprint); got.JKT != want {
+				t.Errorf("JKT = %q, want %q", got.JKT, want)
+			}
+			if got.JTI != tt.claims["jti"] {
+				t.Errorf("JTI = %q, want %q", got.JTI, tt.claims["jti"])
+			}
+		})
+	}
+}
+
+func TestVerifyDPoPProofRejectsOtherKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	// Signed with one key while the header names another
+	proof := signDPoPProof(t, key, "dpop+jwt", jose.JSONWebKey{Key: &other.PublicKey}, jwt.MapClaims{
+		"jti": GenerateID(),
+		"htm": dpopTestMethod,
+		"htu": dpopTestURI,
+		"iat": time.Now().Unix(),
+	})
+	if _, err := VerifyDPoPProof(proof, dpopTestMethod, dpopTestURI, ""); err == nil {
+		t.Fatal("VerifyDPoPProof() accepted a proof signed with a key other than its jwk")
+	}
+}
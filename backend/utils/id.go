@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"strings"
+
 	"github.com/jaevor/go-nanoid"
 )
 
@@ -19,7 +21,30 @@ func GenerateToken() string {
 	return generate()
 }
 
-func GenerateUserCode() string {
-	generate, _ := nanoid.CustomASCII("ABCDEFGHJKLMNPQRSTUVWXYZ23456789", 8)
+// UserCodeAlphabets are the character sets an app can pick for device flow user codes.
+// base20 is the consonant set RFC 8628 suggests: no vowels, so codes never spell words.
+var UserCodeAlphabets = map[string]string{
+	"alphanumeric": "ABCDEFGHJKLMNPQRSTUVWXYZ23456789",
+	"base20":       "BCDFGHJKLMNPQRSTVWXZ",
+	"numeric":      "0123456789",
+}
+
+// GenerateUserCode makes a device flow user code of length characters from the named alphabet.
+func GenerateUserCode(alphabet string, length int) string {
+	chars, ok := UserCodeAlphabets[alphabet]
+	if !ok {
+		chars = UserCodeAlphabets["alphanumeric"]
+	}
+	generate, _ := nanoid.CustomASCII(chars, length)
 	return generate()
 }
+
+// NormalizeUserCode uppercases a typed user code and drops the dashes and spaces users add.
+func NormalizeUserCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func GenerateRefreshToken() string {
+	generate, _ := nanoid.Standard(64)
+	return "rt_" + generate()
+}
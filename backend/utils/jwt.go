@@ -1,100 +1,430 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"log"
 	"mirpass-backend/config"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func GenerateJWTToken(appID, username string, exp time.Duration) (string, error) {
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// MaxAccessTokenLifetime is the longest access token lifetime an app policy may set. Retired
+// signing keys stay published at least this long, so no token outlives the key to verify it.
+const MaxAccessTokenLifetime = 30 * 24 * time.Hour
+
+// IsTokenRevoked is consulted by ValidateToken for every token carrying a jti.
+// It is wired to the database at startup to avoid an import cycle.
+var IsTokenRevoked func(jti string) bool
+
+// GenerateAccessToken issues an app access token following the RFC 9068 JWT profile.
+// It is signed with the published RSA key so resource servers can verify it offline via JWKS.
+// The audience is the app itself unless API resources are given (RFC 8707).
+// A non-nil cnf binds the token to a proof-of-possession key (RFC 7800). The sid of the
+// OAuth session lets all of the session's tokens be revoked at once.
+func GenerateAccessToken(appID, username, scope, sid string, resources []string, exp time.Duration, cnf map[string]string) (string, error) {
+	now := time.Now().UTC()
+	var aud interface{} = appID
+	if len(resources) > 0 {
+		aud = resources
+	}
 	claims := jwt.MapClaims{
+		"iss":       config.AppConfig.BackendURL,
+		"sub":       username,
+		"aud":       aud,
+		"client_id": appID,
+		"jti":       GenerateID(),
+		"exp":       jwt.NewNumericDate(now.Add(exp)),
+		"iat":       jwt.NewNumericDate(now),
+		// Kept for integrations written against the original token format
 		"username": username,
 		"appId":    appID,
-		"iss":      config.AppConfig.BackendURL,
-		"exp":      jwt.NewNumericDate(time.Now().UTC().Add(exp)),
-		"iat":      jwt.NewNumericDate(time.Now().UTC()),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(config.AppConfig.JWTSecret))
+	if scope != "" {
+		claims["scope"] = scope
+	}
+	if sid != "" {
+		claims["sid"] = sid
+	}
+	if cnf != nil {
+		claims["cnf"] = cnf
+	}
+	return signAccessToken(claims)
+}
+
+// GenerateClientAccessToken issues a client_credentials token whose subject is the app itself.
+// It has no username claim, so user-facing endpoints reject it.
+func GenerateClientAccessToken(appID, scope string, exp time.Duration, cnf map[string]string) (string, error) {
+	now := time.Now().UTC()
+	claims := jwt.MapClaims{
+		"iss":       config.AppConfig.BackendURL,
+		"sub":       appID,
+		"aud":       appID,
+		"client_id": appID,
+		"jti":       GenerateID(),
+		"exp":       jwt.NewNumericDate(now.Add(exp)),
+		"iat":       jwt.NewNumericDate(now),
+		"appId":     appID,
+	}
+	if scope != "" {
+		claims["scope"] = scope
+	}
+	if cnf != nil {
+		claims["cnf"] = cnf
+	}
+	return signAccessToken(claims)
+}
+
+// GenerateExchangedAccessToken issues a token exchange result (RFC 8693): a user token for
+// the audience app, requested by clientID, with act naming who acts on the user's behalf.
+// sid is the subject token's, so ending that session revokes the new token too.
+func GenerateExchangedAccessToken(audience, clientID, username, scope, sid string, exp time.Duration, act map[string]interface{}, cnf map[string]string) (string, error) {
+	now := time.Now().UTC()
+	claims := jwt.MapClaims{
+		"iss":       config.AppConfig.BackendURL,
+		"sub":       username,
+		"aud":       audience,
+		"client_id": clientID,
+		"jti":       GenerateID(),
+		"exp":       jwt.NewNumericDate(now.Add(exp)),
+		"iat":       jwt.NewNumericDate(now),
+		"username":  username,
+		"appId":     audience,
+		"act":       act,
+	}
+	if scope != "" {
+		claims["scope"] = scope
+	}
+	if sid != "" {
+		claims["sid"] = sid
+	}
+	if cnf != nil {
+		claims["cnf"] = cnf
+	}
+	return signAccessToken(claims)
 }
 
-func GenerateIDToken(appID, username string, nonce string) (string, error) {
+func signAccessToken(claims jwt.MapClaims) (string, error) {
+	kid, privKey := GetSigningKey()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	token.Header["typ"] = "at+jwt"
+	return token.SignedString(privKey)
+}
+
+// IDTokenOptions carries the optional OIDC claims of an ID token.
+type IDTokenOptions struct {
+	Nonce       string
+	AuthTime    time.Time
+	AccessToken string        // used to derive at_hash
+	Lifetime    time.Duration // defaults to one hour
+	SessionID   string        // published as the sid claim for back-channel logout
+}
+
+func GenerateIDToken(appID, username string, opts IDTokenOptions) (string, error) {
+	lifetime := opts.Lifetime
+	if lifetime <= 0 {
+		lifetime = time.Hour
+	}
 	claims := jwt.MapClaims{
 		"iss": config.AppConfig.BackendURL,
 		"sub": username,
 		"aud": appID,
-		"exp": jwt.NewNumericDate(time.Now().UTC().Add(time.Hour)),
+		"azp": appID,
+		"jti": GenerateID(),
+		"exp": jwt.NewNumericDate(time.Now().UTC().Add(lifetime)),
 		"iat": jwt.NewNumericDate(time.Now().UTC()),
 	}
-	if nonce != "" {
-		claims["nonce"] = nonce
+	if opts.Nonce != "" {
+		claims["nonce"] = opts.Nonce
+	}
+	if opts.SessionID != "" {
+		claims["sid"] = SessionSID(opts.SessionID)
+	}
+	if !opts.AuthTime.IsZero() {
+		claims["auth_time"] = jwt.NewNumericDate(opts.AuthTime.UTC())
+	}
+	if opts.AccessToken != "" {
+		// OIDC Core 3.1.3.6: left half of the SHA-256 digest, base64url encoded
+		sum := sha256.Sum256([]byte(opts.AccessToken))
+		claims["at_hash"] = base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
 	}
 
 	// Get private key from keys manager
-	privKey := GetRSAPrivateKey()
+	kid, privKey := GetSigningKey()
 
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	token.Header["kid"] = GetSigningKeyID()
+	token.Header["kid"] = kid
 	// Sign and get the complete encoded token as a string using the private key
 	return token.SignedString(privKey)
 }
 
+// SessionSID derives the public sid for an OAuth session. The session id itself is
+// a bearer handle during the flow, so it is never published.
+func SessionSID(sessionID string) string {
+	return Sha256(sessionID)
+}
+
+// RevokedSessionKey is the revoked_tokens entry that revokes every token carrying sid.
+func RevokedSessionKey(sid string) string {
+	return "sid:" + sid
+}
+
+// GenerateLogoutToken builds an OIDC back-channel logout token for one session.
+func GenerateLogoutToken(appID, username, sid string) (string, error) {
+	now := time.Now().UTC()
+	claims := jwt.MapClaims{
+		"iss": config.AppConfig.BackendURL,
+		"sub": username,
+		"aud": appID,
+		"iat": jwt.NewNumericDate(now),
+		"exp": jwt.NewNumericDate(now.Add(2 * time.Minute)),
+		"jti": GenerateID(),
+		"events": map[string]interface{}{
+			"http://schemas.openid.net/event/backchannel-logout": map[string]interface{}{},
+		},
+	}
+	if sid != "" {
+		claims["sid"] = sid
+	}
+
+	kid, privKey := GetSigningKey()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	token.Header["typ"] = "logout+jwt"
+	return token.SignedString(privKey)
+}
+
+// GenerateSysToken issues a MirPass dashboard session token. These are HS256 with
+// JWT_SECRET, a key never used for app tokens, so one can't be passed off as the other.
 func GenerateSysToken(userID string) (string, error) {
-	return GenerateJWTToken("system", userID, time.Hour*24*7)
+	now := time.Now().UTC()
+	claims := jwt.MapClaims{
+		"username": userID,
+		"appId":    "system",
+		"jti":      GenerateID(),
+		"iss":      config.AppConfig.BackendURL,
+		"exp":      jwt.NewNumericDate(now.Add(time.Hour * 24 * 7)),
+		"iat":      jwt.NewNumericDate(now),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(config.AppConfig.JWTSecret))
 }
 
+// ErrWrongAudience rejects a token presented to a resource it was not issued for.
+var ErrWrongAudience = errors.New("token is not valid for this resource")
+
+// ValidateToken accepts app access tokens as well as dashboard tokens, for use by MirPass
+// itself. Tokens restricted to API resources are rejected.
 func ValidateToken(tokenString string) (Claims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.AppConfig.JWTSecret), nil
-	})
+	return ValidateTokenForResource(tokenString, "")
+}
 
+// ValidateTokenForResource is ValidateToken for a resource server: the token's audience must
+// include the resource identifier. An empty resource stands for MirPass and the app itself.
+func ValidateTokenForResource(tokenString string, resource string) (Claims, error) {
+	claim, err := validateAccessToken(tokenString)
 	if err != nil {
 		return Claims{}, err
 	}
+	if resource == "" {
+		if len(claim.Audience) > 0 && !slices.Contains(claim.Audience, claim.AppID) {
+			return Claims{}, ErrWrongAudience
+		}
+	} else if !slices.Contains(claim.Audience, resource) {
+		return Claims{}, ErrWrongAudience
+	}
+	return claim, nil
+}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
+func validateAccessToken(tokenString string) (Claims, error) {
+	token, claims, err := parseVerified(tokenString)
+	if err != nil {
+		return Claims{}, err
+	}
 
-	// Allow any valid appId
-	if ok && token.Valid {
-		appID, ok := claims["appId"].(string)
-		if !ok {
-			return Claims{}, jwt.ErrInvalidKey
-		}
+	if token.Method.Alg() != jwt.SigningMethodRS256.Alg() {
+		// JWT_SECRET only ever signs dashboard tokens
+		return validateSysClaims(tokenString)
+	}
 
-		userID := claims["username"].(string)
-		return Claims{Username: userID, AppID: appID}, nil
+	// ID tokens share the RSA key; only at+jwt tokens grant API access
+	if typ, _ := token.Header["typ"].(string); typ != "at+jwt" {
+		return Claims{}, jwt.ErrTokenInvalidClaims
 	}
+	if clientID, _ := claims["client_id"].(string); clientID == "" || clientID == "system" {
+		return Claims{}, jwt.ErrTokenInvalidClaims
+	}
+	return toClaims(claims)
+}
 
-	return Claims{}, jwt.ErrSignatureInvalid
+func toClaims(claims jwt.MapClaims) (Claims, error) {
+	appID, _ := claims["appId"].(string)
+	if appID == "" {
+		appID, _ = claims["client_id"].(string)
+	}
+	// Client credentials tokens have no username and never act for a user
+	username, _ := claims["username"].(string)
+	if appID == "" || username == "" {
+		return Claims{}, jwt.ErrTokenInvalidClaims
+	}
+
+	jti, _ := claims["jti"].(string)
+	scope, _ := claims["scope"].(string)
+	var issuedAt, expiresAt time.Time
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		issuedAt = iat.Time
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		expiresAt = exp.Time
+	}
+	audience, _ := claims.GetAudience()
+	var certThumbprint, dpopJKT string
+	if cnf, ok := claims["cnf"].(map[string]interface{}); ok {
+		certThumbprint, _ = cnf["x5t#S256"].(string)
+		dpopJKT, _ = cnf["jkt"].(string)
+	}
+	return Claims{Username: username, AppID: appID, JTI: jti, Scope: scope, IssuedAt: issuedAt, ExpiresAt: expiresAt, Audience: audience, CertThumbprint: certThumbprint, DPoPJKT: dpopJKT}, nil
 }
 
 type Claims struct {
-	Username string
-	AppID    string
+	Username  string
+	AppID     string
+	JTI       string
+	Scope     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	Audience  []string
+	// CertThumbprint and DPoPJKT are set on access tokens bound to a client certificate or DPoP key
+	CertThumbprint string
+	DPoPJKT        string
 }
 
-func ValidateSysToken(tokenString string) (string, error) {
-	claim, err := ValidateToken(tokenString)
+// ParseAnyToken verifies any token issued by this server (dashboard, access or ID token)
+// and returns its raw claims. Expiry and revocation are still enforced.
+func ParseAnyToken(tokenString string) (jwt.MapClaims, error) {
+	_, claims, err := parseVerified(tokenString)
+	return claims, err
+}
+
+func parseVerified(tokenString string) (*jwt.Token, jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.Alg() {
+		case jwt.SigningMethodHS256.Alg():
+			return []byte(config.AppConfig.JWTSecret), nil
+		case jwt.SigningMethodRS256.Alg():
+			kid, _ := token.Header["kid"].(string)
+			if key, ok := GetRSAPublicKey(kid); ok {
+				return key, nil
+			}
+			return nil, jwt.ErrTokenUnverifiable
+		}
+		return nil, jwt.ErrTokenSignatureInvalid
+	}, jwt.WithValidMethods([]string{"HS256", "RS256"}))
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, nil, jwt.ErrTokenInvalidClaims
+	}
+	if jti, _ := claims["jti"].(string); jti != "" && IsTokenRevoked != nil && IsTokenRevoked(jti) {
+		return nil, nil, ErrTokenRevoked
+	}
+	// A whole session is revoked by listing its sid
+	if sid, _ := claims["sid"].(string); sid != "" && IsTokenRevoked != nil && IsTokenRevoked(RevokedSessionKey(sid)) {
+		return nil, nil, ErrTokenRevoked
+	}
+	return token, claims, nil
+}
+
+// ParseAccessToken verifies an app access token, user or client_credentials, and returns its claims.
+func ParseAccessToken(tokenString string) (jwt.MapClaims, error) {
+	token, claims, err := parseVerified(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if typ, _ := token.Header["typ"].(string); typ != "at+jwt" || token.Method.Alg() != jwt.SigningMethodRS256.Alg() {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	return claims, nil
+}
+
+// ParseIDTokenHint verifies an ID token we issued for use as an id_token_hint.
+// Expiry is deliberately not checked: OIDC allows expired ID tokens as logout hints.
+func ParseIDTokenHint(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := GetRSAPublicKey(kid); ok {
+			return key, nil
+		}
+		return nil, jwt.ErrTokenUnverifiable
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithoutClaimsValidation())
+	if err != nil {
+		return nil, err
+	}
+	// Access and logout tokens share the key and claims; only ID tokens have no explicit type
+	if typ, _ := token.Header["typ"].(string); typ != "" && typ != "JWT" {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	if _, ok := claims["events"]; ok {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	if iss, _ := claims.GetIssuer(); iss != config.AppConfig.BackendURL {
+		return nil, jwt.ErrTokenInvalidIssuer
+	}
+	return claims, nil
+}
+
+// validateSysClaims only accepts HS256 dashboard tokens for the system app.
+func validateSysClaims(tokenString string) (Claims, error) {
+	token, claims, err := parseVerified(tokenString)
+	if err != nil {
+		return Claims{}, err
+	}
+	if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+		return Claims{}, jwt.ErrTokenSignatureInvalid
+	}
+
+	claim, err := toClaims(claims)
+	if err != nil {
+		return Claims{}, err
 	}
 	// Enforce system appId for system tokens
 	if claim.AppID != "system" {
-		return "", jwt.ErrSignatureInvalid
+		return Claims{}, jwt.ErrSignatureInvalid
+	}
+	return claim, nil
+}
+
+func ValidateSysToken(tokenString string) (string, error) {
+	claim, err := validateSysClaims(tokenString)
+	if err != nil {
+		return "", err
 	}
 	return claim.Username, nil
 }
 
+// ExtractClaims reads the dashboard token from the Authorization header.
+// App access tokens are rejected: these callers act on behalf of the signed-in user.
 func ExtractClaims(r *http.Request) (*Claims, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader != "" {
 		parts := strings.Split(authHeader, " ")
 		if len(parts) == 2 && parts[0] == "Bearer" {
-			claims, err := ValidateToken(parts[1])
+			claims, err := validateSysClaims(parts[1])
 			if err == nil {
 				return &claims, nil
 			}
@@ -3,6 +3,9 @@ package utils
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
 	"log"
 	"sync"
 
@@ -11,13 +14,22 @@ import (
 
 var (
 	rsaPrivateKey *rsa.PrivateKey
+	signingKeyID  string
+	publicKeys    map[string]*rsa.PublicKey
 	jwks          *jose.JSONWebKeySet
 	keysMutex     sync.RWMutex
 )
 
-const signingKeyID = "mirpass-rs256-1"
+const ephemeralKeyID = "mirpass-rs256-ephemeral"
 
-// InitKeys initializes RSA keys for OIDC signing
+// PublishedKey is a verification key exposed in the JWKS.
+type PublishedKey struct {
+	KeyID     string
+	PublicKey *rsa.PublicKey
+}
+
+// InitKeys generates an in-memory RSA key for OIDC signing. It is only a fallback for
+// when no persistent keys could be loaded; tokens signed with it do not survive a restart.
 func InitKeys() {
 	keysMutex.Lock()
 	defer keysMutex.Unlock()
@@ -26,22 +38,44 @@ func InitKeys() {
 		return
 	}
 
-	var err error
-	rsaPrivateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	log.Println("WARNING: no persistent signing key loaded, using an ephemeral RSA key")
+	key, err := GenerateRSAKey()
 	if err != nil {
 		log.Fatal("Failed to generate RSA key:", err)
 	}
+	setKeysLocked(ephemeralKeyID, key, nil)
+}
 
-	jwk := jose.JSONWebKey{
-		Key:       &rsaPrivateKey.PublicKey,
-		KeyID:     signingKeyID,
-		Algorithm: "RS256",
-		Use:       "sig",
-	}
+// SetSigningKeys installs the active signing key and the set of keys published for verification.
+// The active key is always published, so others only needs to list keys in their overlap window.
+func SetSigningKeys(activeKeyID string, active *rsa.PrivateKey, others []PublishedKey) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	setKeysLocked(activeKeyID, active, others)
+}
 
-	jwks = &jose.JSONWebKeySet{
-		Keys: []jose.JSONWebKey{jwk},
+func setKeysLocked(activeKeyID string, active *rsa.PrivateKey, others []PublishedKey) {
+	all := append([]PublishedKey{{KeyID: activeKeyID, PublicKey: &active.PublicKey}}, others...)
+
+	set := &jose.JSONWebKeySet{}
+	keys := make(map[string]*rsa.PublicKey, len(all))
+	for _, k := range all {
+		if _, dup := keys[k.KeyID]; dup {
+			continue
+		}
+		keys[k.KeyID] = k.PublicKey
+		set.Keys = append(set.Keys, jose.JSONWebKey{
+			Key:       k.PublicKey,
+			KeyID:     k.KeyID,
+			Algorithm: "RS256",
+			Use:       "sig",
+		})
 	}
+
+	rsaPrivateKey = active
+	signingKeyID = activeKeyID
+	publicKeys = keys
+	jwks = set
 }
 
 // GetJWKS returns the JSON Web Key Set
@@ -74,7 +108,63 @@ func GetRSAPrivateKey() *rsa.PrivateKey {
 	return currentPrivateKey
 }
 
+// GetRSAPublicKey returns a published verification key by its Key ID
+func GetRSAPublicKey(kid string) (*rsa.PublicKey, bool) {
+	GetRSAPrivateKey() // make sure keys are initialized
+	keysMutex.RLock()
+	defer keysMutex.RUnlock()
+	key, ok := publicKeys[kid]
+	return key, ok
+}
+
 // GetSigningKeyID returns the Key ID of the current signing key
 func GetSigningKeyID() string {
-	return signingKeyID
+	kid, _ := GetSigningKey()
+	return kid
+}
+
+// GetSigningKey returns the current signing key together with its Key ID, read atomically
+// so a concurrent rotation can never pair one key with another key's kid.
+func GetSigningKey() (string, *rsa.PrivateKey) {
+	GetRSAPrivateKey()
+	keysMutex.RLock()
+	defer keysMutex.RUnlock()
+	return signingKeyID, rsaPrivateKey
+}
+
+func GenerateRSAKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// EncodeRSAPrivateKeyPEM serializes a private key as a PKCS#8 PEM block.
+func EncodeRSAPrivateKeyPEM(key *rsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParseRSAPrivateKeyPEM accepts both PKCS#1 ("RSA PRIVATE KEY") and PKCS#8 ("PRIVATE KEY") blocks.
+func ParseRSAPrivateKeyPEM(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("PEM key is not an RSA key")
+		}
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
 }
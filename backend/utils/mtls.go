@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"mirpass-backend/config"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	clientCAs      *x509.CertPool
+	trustedProxies []*net.IPNet
+)
+
+// InitMTLS loads the client CA bundle and the proxies trusted to forward client certificates.
+func InitMTLS() error {
+	if path := config.AppConfig.TLSClientCAFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("client CA file has no certificates")
+		}
+		clientCAs = pool
+	}
+
+	networks, err := parseNetworks(config.AppConfig.MTLSTrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	trustedProxies = networks
+	return nil
+}
+
+// ServerTLSConfig asks clients for a certificate without requiring one. Chains are checked
+// per request, since pinned self-signed certificates are accepted too.
+func ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequestClientCert,
+	}
+}
+
+// ClientCertificates returns the certificate chain the client presented, leaf first: from
+// the TLS connection, or from the configured header when the request came through a
+// trusted proxy. It returns nil when there is none.
+func ClientCertificates(r *http.Request) []*x509.Certificate {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates
+	}
+
+	header := config.AppConfig.MTLSCertHeader
+	if header == "" || !fromTrustedProxy(r) {
+		return nil
+	}
+	raw, err := url.QueryUnescape(r.Header.Get(header))
+	if err != nil || raw == "" {
+		return nil
+	}
+	var certs []*x509.Certificate
+	for rest := []byte(raw); ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return inNetworks(host, trustedProxies)
+}
+
+// CertThumbprint is the base64url SHA-256 of the certificate, as used in the cnf x5t#S256 claim.
+func CertThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyClientCertChain checks that the leaf chains up to the configured client CAs.
+func VerifyClientCertChain(certs []*x509.Certificate) bool {
+	if clientCAs == nil || len(certs) == 0 {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// ParseCertThumbprint accepts a PEM certificate or an x5t#S256 thumbprint and returns the thumbprint.
+func ParseCertThumbprint(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if block, _ := pem.Decode([]byte(value)); block != nil {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("invalid certificate: %w", err)
+		}
+		return CertThumbprint(cert), nil
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sum) != sha256.Size {
+		return "", errors.New("thumbprint must be a base64url SHA-256 digest")
+	}
+	return value, nil
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Redirect URI kinds (RFC 8252). Web URIs match exactly, loopback URIs match on any port,
+// and custom-scheme URIs belong to native apps claiming a reverse-domain scheme. Invalid
+// marks entries saved before validation, such as wildcards, which match nothing.
+const (
+	RedirectURIWeb      = "web"
+	RedirectURILoopback = "loopback"
+	RedirectURICustom   = "custom"
+	RedirectURIInvalid  = "invalid"
+)
+
+// reverseDomainScheme is a private-use scheme such as com.example.app: lowercase labels
+// separated by dots, with at least two labels.
+var reverseDomainScheme = regexp.MustCompile(`^[a-z][a-z0-9-]*(\.[a-z0-9][a-z0-9-]*)+$`)
+
+// ClassifyRedirectURI validates a redirect URI for registration and returns its kind.
+func ClassifyRedirectURI(raw string) (string, error) {
+	if raw == "" || len(raw) > 512 {
+		return "", errors.New("redirect URI must be 1 to 512 characters")
+	}
+	if strings.Contains(raw, "*") {
+		return "", errors.New("wildcards are not allowed in redirect URIs")
+	}
+	if strings.Contains(raw, "#") {
+		return "", errors.New("redirect URIs cannot have a fragment")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return "", errors.New("redirect URI must be absolute")
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" || u.User != nil {
+			return "", errors.New("redirect URI must have a host and no credentials")
+		}
+		if isLoopbackIP(u.Hostname()) {
+			if u.Scheme != "http" {
+				return "", errors.New("loopback redirect URIs use http")
+			}
+			return RedirectURILoopback, nil
+		}
+		return RedirectURIWeb, nil
+	default:
+		// Schemes are case-insensitive, so url.Parse lowercases them; compare the original
+		if !reverseDomainScheme.MatchString(raw[:len(u.Scheme)]) {
+			return "", errors.New("custom schemes must be a reverse domain name such as com.example.app")
+		}
+		return RedirectURICustom, nil
+	}
+}
+
+// RedirectURIMatches reports whether a requested redirect URI matches a registered one of
+// the given kind. Loopback URIs may differ in port only, since native apps listen on an
+// ephemeral port; everything else must be identical.
+func RedirectURIMatches(kind, registered, requested string) bool {
+	if kind == RedirectURIInvalid {
+		return false
+	}
+	if kind != RedirectURILoopback {
+		return registered == requested
+	}
+	reg, err := url.Parse(registered)
+	if err != nil {
+		return false
+	}
+	req, err := url.Parse(requested)
+	if err != nil || req.Scheme != "http" || req.User != nil || req.Fragment != "" {
+		return false
+	}
+	return req.Hostname() == reg.Hostname() &&
+		req.EscapedPath() == reg.EscapedPath() &&
+		req.RawQuery == reg.RawQuery
+}
+
+// isLoopbackIP accepts only the literal loopback addresses. RFC 8252 advises against
+// "localhost", which can resolve elsewhere; it is treated as an ordinary web host.
+func isLoopbackIP(host string) bool {
+	return host == "127.0.0.1" || net.ParseIP(host).Equal(net.IPv6loopback)
+}
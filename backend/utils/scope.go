@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SupportedScopes lists every scope a client may request.
+var SupportedScopes = []string{"openid", "profile", "email"}
+
+// DefaultScope is granted when a client does not send a scope parameter.
+// Email is deliberately left out so it is only released on request.
+const DefaultScope = "openid profile"
+
+// NormalizeScope validates a space-delimited scope string and returns it deduplicated
+// in a stable order. An empty input yields DefaultScope.
+func NormalizeScope(raw string) (string, error) {
+	return NormalizeScopeWith(raw, nil)
+}
+
+// NormalizeScopeWith is NormalizeScope that also accepts the scopes of requested API
+// resources. Those follow the standard scopes, in the order they are listed in extra.
+func NormalizeScopeWith(raw string, extra []string) (string, error) {
+	requested := strings.Fields(raw)
+	if len(requested) == 0 {
+		return DefaultScope, nil
+	}
+
+	allowed := append(slices.Clone(SupportedScopes), extra...)
+	var scopes []string
+	for _, s := range requested {
+		if !slices.Contains(allowed, s) {
+			return "", fmt.Errorf("unsupported scope: %s", s)
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	slices.SortFunc(scopes, func(a, b string) int {
+		return slices.Index(allowed, a) - slices.Index(allowed, b)
+	})
+	return strings.Join(scopes, " "), nil
+}
+
+// HasScope reports whether the space-delimited scope string contains want.
+func HasScope(scope string, want string) bool {
+	return slices.Contains(strings.Fields(scope), want)
+}
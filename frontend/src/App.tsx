@@ -13,6 +13,7 @@ const AdminPage = lazy(() => import("./pages/Admin"));
 const CreateAppPage = lazy(() => import("./pages/CreateApp"));
 const ManageAppPage = lazy(() => import("./pages/ManageApp"));
 const AboutPage = lazy(() => import("./pages/About"));
+const LogoutPage = lazy(() => import("./pages/Logout"));
 
 import Nav from "./components/Nav";
 import { useAppStore } from "./store/useAppStore";
@@ -107,6 +108,7 @@ function App() {
                 <Route path="/forget" element={<ForgetPage />} />
                 <Route path="/verify" element={<VerifyPage />} />
                 <Route path="/about" element={<AboutPage />} />
+                <Route path="/logout" element={<LogoutPage />} />
                 <Route
                   path="/dashboard"
                   element={
@@ -13,6 +13,7 @@ import {
   Upload,
   App,
   Modal,
+  Switch,
 } from "antd";
 import dayjs from "dayjs";
 import { parseDate } from "../utils/date";
@@ -44,6 +45,7 @@ type AdminAppView = {
   description: string;
   logoUrl?: string;
   suspendUntil?: string | null; // Allow null
+  firstParty?: boolean;
   created_at: string;
 };
 
@@ -354,6 +356,16 @@ function AppsTab({ systemRole: _systemRole }: { systemRole: string }) {
     }
   };
 
+  const handleFirstParty = async (appId: string, firstParty: boolean) => {
+    try {
+      await api.post("/admin/app/first-party", { appId, firstParty });
+      message.success("App updated");
+      fetchApps();
+    } catch (error) {
+      message.error("Failed to update app");
+    }
+  };
+
   const handleDelete = async (appId: string) => {
     modal.confirm({
       title: "Delete App?",
@@ -405,6 +417,20 @@ function AppsTab({ systemRole: _systemRole }: { systemRole: string }) {
         />
       ),
     },
+    {
+      title: "First-party",
+      dataIndex: "firstParty",
+      key: "firstParty",
+      render: (firstParty: boolean, record: AdminAppView) => (
+        <Switch
+          size="small"
+          checked={!!firstParty}
+          disabled={record.id === "system"}
+          onChange={(checked) => handleFirstParty(record.id, checked)}
+          title="Users are not asked for consent"
+        />
+      ),
+    },
     {
       title: "Actions",
       key: "actions",
@@ -1,4 +1,4 @@
-import { useEffect, useState } from "react";
+import { useCallback, useEffect, useRef, useState } from "react";
 import { useNavigate, useSearchParams } from "react-router-dom";
 import {
   Button,
@@ -66,15 +66,67 @@ function AuthorizePage() {
     }
   }, [urlUserCode, setSsoType, setSsoUserCode]);
 
-  // For unauthenticated device flow, resolve session first, then redirect to login
+  // prompt=none: the backend either issues the code or sends an error back to the app.
+  // It also completes requests the user already consented to, falling back to the consent screen
+  const silentStarted = useRef(false);
+  const [showConsent, setShowConsent] = useState(false);
+  const authorizeSilently = useCallback(
+    async (sessionId: string, onFailure?: () => void) => {
+      if (silentStarted.current) return;
+      silentStarted.current = true;
+      try {
+        const { data } = await api.post("/authorize/consent/silent", {
+          sessionId,
+        });
+        if (data?.data?.redirectUrl) {
+          window.location.href = data.data.redirectUrl;
+        } else {
+          message.error("Invalid response from server");
+        }
+      } catch (e) {
+        if (onFailure) {
+          onFailure();
+        } else {
+          message.error("Failed to authorize request");
+        }
+      }
+    },
+    [message],
+  );
+
+  // For unauthenticated flows, resolve session first, then redirect to login
   useEffect(() => {
     if (token) {
       return;
     }
 
     if (storeSessionId) {
-      navigate(`/login`, { replace: true });
-      return;
+      let cancelled = false;
+      setFetchingDetails(true);
+      fetchSsoDetails()
+        .catch((error) => {
+          console.error("Failed to fetch SSO details", error);
+        })
+        .then(() => {
+          if (cancelled) {
+            return;
+          }
+          const details = useAppStore.getState().ssoDetails;
+          if (details?.prompt === "none" && details.status === "pending") {
+            authorizeSilently(storeSessionId);
+          } else {
+            navigate(`/login`, { replace: true });
+          }
+        })
+        .finally(() => {
+          if (!cancelled) {
+            setFetchingDetails(false);
+          }
+        });
+
+      return () => {
+        cancelled = true;
+      };
     }
 
     if (!urlUserCode) {
@@ -115,6 +167,7 @@ function AuthorizePage() {
     fetchSsoDetails,
     navigate,
     message,
+    authorizeSilently,
   ]);
 
   // Fetch Details
@@ -143,6 +196,45 @@ function AuthorizePage() {
     setSsoSessionId,
   ]);
 
+  // Honour prompt=none, prompt=login and max_age before showing the consent screen
+  const silentRequest =
+    storeSsoType === "auth_code" &&
+    ssoDetails?.status === "pending" &&
+    ssoDetails.prompt === "none";
+  const reloginRequired =
+    storeSsoType === "auth_code" &&
+    ssoDetails?.status === "pending" &&
+    !!ssoDetails.loginRequired;
+  // First-party apps and apps the user already approved skip the consent screen
+  const consentRemembered =
+    storeSsoType === "auth_code" &&
+    ssoDetails?.status === "pending" &&
+    ssoDetails.consentRequired === false &&
+    !showConsent;
+
+  useEffect(() => {
+    if (!token || !ssoSessionId) {
+      return;
+    }
+    if (silentRequest) {
+      authorizeSilently(ssoSessionId);
+    } else if (reloginRequired) {
+      logout();
+      navigate("/login", { replace: true });
+    } else if (consentRemembered) {
+      authorizeSilently(ssoSessionId, () => setShowConsent(true));
+    }
+  }, [
+    token,
+    ssoSessionId,
+    silentRequest,
+    reloginRequired,
+    consentRemembered,
+    authorizeSilently,
+    logout,
+    navigate,
+  ]);
+
   const handleConfirmSSO = async (approve: boolean) => {
     if (!ssoDetails || !ssoSessionId) {
       message.error("Missing SSO session details");
@@ -194,7 +286,12 @@ function AuthorizePage() {
     navigate("/login", { replace: true });
   };
 
-  if (!ssoDetails && fetchingDetails) {
+  if (
+    (!ssoDetails && fetchingDetails) ||
+    silentRequest ||
+    reloginRequired ||
+    consentRemembered
+  ) {
     return <LoadingView />;
   }
 
@@ -227,7 +324,7 @@ function AuthorizePage() {
               placeholder="ABCD1234"
               size="large"
               className="text-center tracking-widest uppercase font-mono"
-              maxLength={8}
+              maxLength={20}
               onChange={(e) => {
                 e.target.value = e.target.value.toUpperCase();
               }}
@@ -303,6 +400,22 @@ function AuthorizePage() {
               </Text>
             )
             }
+            {storeSsoType === "device_code" &&
+              (ssoDetails.deviceIp || ssoDetails.deviceUserAgent) && (
+                <div className="text-left text-xs mt-4 w-full">
+                  <Text type="secondary" className="block">
+                    {t('auth.requested-from')} {ssoDetails.deviceIp}
+                  </Text>
+                  {ssoDetails.deviceUserAgent && (
+                    <Text type="secondary" className="block break-all">
+                      {ssoDetails.deviceUserAgent}
+                    </Text>
+                  )}
+                  <Text type="secondary" className="block mt-1">
+                    {t('auth.device-not-yours')}
+                  </Text>
+                </div>
+              )}
           </div>
 
           <Divider style={{ margin: 0 }} />
@@ -40,7 +40,7 @@ import {
 } from "lucide-react";
 import { formatDateTime } from "../utils/date";
 
-import type { ErrorResponse, LoginHistoryItem } from "../types";
+import type { ConnectedApp, ErrorResponse, LoginHistoryItem } from "../types";
 import api from "../api/client";
 import type { SimpleResponse } from "../types";
 import { useAppStore } from "../store/useAppStore";
@@ -62,15 +62,17 @@ function DashboardPage() {
     isLoadingProfile,
   } = useAppStore();
   const { t } = useTranslation();
-  const { message } = App.useApp();
+  const { message, modal } = App.useApp();
   const [loadingKey, setLoadingKey] = useState<string | null>(null);
   const [loginHistory, setLoginHistory] = useState<LoginHistoryItem[]>([]);
   const [appsSummary, setAppsSummary] = useState<LoginHistoryItem[]>([]);
+  const [connectedApps, setConnectedApps] = useState<ConnectedApp[]>([]);
   const [selectedDate, setSelectedDate] = useState<dayjs.Dayjs | null>(null);
 
   useEffect(() => {
     fetchMyApps();
     fetchSummary();
+    fetchConnectedApps();
   }, []);
 
   useEffect(() => {
@@ -86,6 +88,34 @@ function DashboardPage() {
     }
   };
 
+  const fetchConnectedApps = async () => {
+    try {
+      const { data } = await api.get("/user/apps/connected");
+      setConnectedApps(data.data || []);
+    } catch {
+      // ignore
+    }
+  };
+
+  const handleRevokeApp = (app: ConnectedApp) => {
+    modal.confirm({
+      title: t('dash.revoke-access-to', { app: app.app }),
+      content: t('dash.revoke-access-confirm'),
+      okType: "danger",
+      okText: t('dash.revoke-access'),
+      onOk: async () => {
+        try {
+          await api.post("/user/apps/connected/revoke", { appId: app.appId });
+          message.success(t('dash.access-revoked'));
+          fetchConnectedApps();
+        } catch (e) {
+          const err = e as ErrorResponse;
+          message.error(err.response?.data?.error || "Failed to revoke access");
+        }
+      },
+    });
+  };
+
   const fetchLoginHistory = async (date: dayjs.Dayjs | null) => {
     try {
       let url = "/user/history";
@@ -478,6 +508,55 @@ function DashboardPage() {
       </Space>
 
 
+      {/* Connected Apps */}
+      <Space orientation="vertical" style={{ width: "100%" }} className="mb-8">
+        <Space align="center" size={12}>
+          <ShieldIcon className="text-primary-500" size={16} />
+          <Text strong className="text-base">
+            {t('dash.connected-apps')}
+          </Text>
+        </Space>
+
+        <Row gutter={[16, 16]} className="mt-4">
+          {connectedApps.map((app) => (
+            <Col xs={24} sm={12} md={8} lg={6} key={app.appId}>
+              <Card size="small" className="hover:shadow-md transition-shadow">
+                <div className="flex flex-col gap-2">
+                  <Flex align="center" justify="space-between" gap={10}>
+                    <Flex align="center" gap={10}>
+                      <AnyAvatar
+                        url={{ url: app.logoUrl, text: app.app }}
+                        size={"small"}
+                      />
+                      <Text strong>{app.app}</Text>
+                    </Flex>
+                    <Button
+                      danger
+                      type="text"
+                      size="small"
+                      onClick={() => handleRevokeApp(app)}
+                    >
+                      {t('dash.revoke-access')}
+                    </Button>
+                  </Flex>
+                  <div className="text-xs text-gray-500">
+                    {app.scopes.join(" ")}
+                  </div>
+                  <div className="text-xs text-gray-500">
+                    {t('dash.granted-on')} {formatDateTime(app.grantedAt)}
+                  </div>
+                </div>
+              </Card>
+            </Col>
+          ))}
+          {connectedApps.length === 0 && (
+            <Text type="secondary" className="pl-4">
+              {t('dash.no-connected-apps')}
+            </Text>
+          )}
+        </Row>
+      </Space>
+
       <Space orientation="vertical" style={{ width: "100%" }} className="mb-8">
         <Space align="center" size={12}>
           <AppWindowIcon className="text-primary-500" size={16} />
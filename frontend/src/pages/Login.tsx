@@ -46,7 +46,7 @@ function LoginPage({ isAuthenticated }: Props) {
   
   const [searchParams, setSearchParams] = useSearchParams();
   const {
-    ssoSessionId, setToken
+    ssoSessionId, ssoDetails, setToken
   } = useAppStore();
 
   // Redirect if already authenticated
@@ -109,7 +109,14 @@ function LoginPage({ isAuthenticated }: Props) {
           </Text>
         </Space>
 
-        <Form layout="vertical" onFinish={handleFinish} requiredMark={false}>
+        <Form
+          layout="vertical"
+          onFinish={handleFinish}
+          requiredMark={false}
+          initialValues={{
+            username: ssoSessionId ? ssoDetails?.loginHint : undefined,
+          }}
+        >
           <Form.Item
             label={t('username')}
             name="username"
@@ -0,0 +1,141 @@
+import { useCallback, useEffect, useRef, useState } from "react";
+import { useNavigate, useSearchParams } from "react-router-dom";
+import { Button, Card, Space, Typography } from "antd";
+import { CircleCheck, CircleX, LogOut } from "lucide-react";
+import { useTranslation } from "react-i18next";
+import { useAppStore } from "../store/useAppStore";
+import { AnyAvatar } from "../components/Avatars";
+import { LoadingView } from "../components/LoadingView";
+import api from "../api/client";
+
+const { Title, Text } = Typography;
+
+type LogoutDetails = {
+  appId?: string;
+  appName?: string;
+  username?: string;
+};
+
+function LogoutPage() {
+  const navigate = useNavigate();
+  const [searchParams] = useSearchParams();
+  const { t } = useTranslation();
+  const { token, profile, logout } = useAppStore();
+
+  const logoutId = searchParams.get("logout_id");
+  const [details, setDetails] = useState<LogoutDetails | null>(null);
+  const [failed, setFailed] = useState(false);
+  const [signingOut, setSigningOut] = useState(false);
+  const [done, setDone] = useState(false);
+  const started = useRef(false);
+
+  const complete = useCallback(async () => {
+    if (started.current) return;
+    started.current = true;
+    setSigningOut(true);
+    try {
+      const { data } = await api.post<{ data: { redirectUri: string } }>(
+        "/oauth2/logout/confirm",
+        { logoutId },
+      );
+      logout();
+      if (data.data?.redirectUri) {
+        window.location.href = data.data.redirectUri;
+        return;
+      }
+      setDone(true);
+    } catch {
+      setFailed(true);
+    } finally {
+      setSigningOut(false);
+    }
+  }, [logoutId, logout]);
+
+  useEffect(() => {
+    if (!logoutId) {
+      setFailed(true);
+      return;
+    }
+    api
+      .get<{ data: LogoutDetails }>("/oauth2/logout/request", {
+        params: { logout_id: logoutId },
+      })
+      .then(({ data }) => setDetails(data.data))
+      .catch(() => setFailed(true));
+  }, [logoutId]);
+
+  // Skip the prompt when there is no session to end, or the app proved who is signing out
+  const needsConfirm =
+    !!token && (!details?.username || details.username !== profile?.username);
+  const waitingForProfile = !!token && !!details?.username && !profile;
+
+  useEffect(() => {
+    if (details && !waitingForProfile && !needsConfirm) {
+      complete();
+    }
+  }, [details, waitingForProfile, needsConfirm, complete]);
+
+  if (failed) {
+    return (
+      <Card className="max-w-sm w-full">
+        <div className="text-center py-8">
+          <CircleX className="text-red-500 mb-4 mx-auto" size={64} />
+          <Text className="block">{t("logout.logout-request-invalid")}</Text>
+        </div>
+      </Card>
+    );
+  }
+
+  if (done) {
+    return (
+      <Card className="max-w-sm w-full">
+        <div className="text-center py-8">
+          <CircleCheck className="text-green-500 mb-4 mx-auto" size={64} />
+          <Text className="block mb-6">{t("logout.you-have-signed-out")}</Text>
+          <Button onClick={() => navigate("/login", { replace: true })}>
+            {t("sign-in")}
+          </Button>
+        </div>
+      </Card>
+    );
+  }
+
+  if (!details || waitingForProfile || signingOut || !needsConfirm) {
+    return <LoadingView />;
+  }
+
+  return (
+    <Card className="max-w-sm w-full" title={t("logout.sign-out-of-mirpass")}>
+      <Space direction="vertical" size="large" className="w-full">
+        {details.appName ? (
+          <Space>
+            <AnyAvatar appId={details.appId} />
+            <Text>
+              <Text strong>{details.appName}</Text>{" "}
+              {t("logout.wants-to-sign-you-out")}
+            </Text>
+          </Space>
+        ) : (
+          <Title level={5}>{t("logout.do-you-want-to-sign-out")}</Title>
+        )}
+        {details.username && details.username !== profile?.username && (
+          <Text type="warning">{t("logout.signed-in-as-different-user")}</Text>
+        )}
+        <Button
+          type="primary"
+          block
+          size="large"
+          icon={<LogOut size={16} />}
+          onClick={complete}
+        >
+          {t("logout.sign-out")}
+        </Button>
+        <Button block onClick={() => navigate("/dashboard", { replace: true })}>
+          {t("logout.stay-signed-in")}
+        </Button>
+      </Space>
+    </Card>
+  );
+}
+
+export default LogoutPage;
@@ -313,6 +313,12 @@ function SecurityTab({ app }: { app: AppDetails }) {
       key: "uri",
       render: (text: string) => <Text copyable>{text}</Text>,
     },
+    {
+      title: "Type",
+      dataIndex: "kind",
+      key: "kind",
+      render: (kind: TrustedUri["kind"]) => <Tag color={kind === "invalid" ? "red" : undefined}>{kind}</Tag>,
+    },
     {
       title: "Added At",
       dataIndex: "createdAt",
@@ -541,7 +547,10 @@ function SecurityTab({ app }: { app: AppDetails }) {
           </Form.Item>
         </Form>
         <Paragraph>
-          Enter full URI including scheme. Wildcard(*) suffix is allowed.
+          Enter the full URI including scheme. Web URIs must match exactly.
+          Loopback URIs (http://127.0.0.1/callback) match on any port, for
+          native apps. Custom schemes must be a reverse domain name, such as
+          com.example.app:/callback.
         </Paragraph>
       </Modal>
     </div>
@@ -1311,7 +1320,7 @@ function DeviceCodeFlowGuide({ app }: { app: AppDetails }) {
     if (!deviceCodeData || pollResult) return;
 
     let timer: any;
-    const intervalMs = (deviceCodeData.interval || 5) * 1000;
+    let intervalMs = (deviceCodeData.interval || 5) * 1000;
 
     const doPoll = async () => {
       try {
@@ -1335,8 +1344,10 @@ function DeviceCodeFlowGuide({ app }: { app: AppDetails }) {
           // continue
           timer = setTimeout(doPoll, intervalMs);
         } else if (errCode === "slow_down") {
+          // The interval stays 5 seconds longer for every slow_down
           setPollStatus("Slowing down...");
-          timer = setTimeout(doPoll, intervalMs + 5000);
+          intervalMs += 5000;
+          timer = setTimeout(doPoll, intervalMs);
         } else {
           setPollStatus("Failed or Expired: " + (errCode || "Unknown"));
           setDeviceCodeData(null);
@@ -1745,9 +1756,11 @@ function StatsTab({ app }: { app: AppDetails }) {
                   title: "User",
                   dataIndex: "user",
                   key: "user",
-                  render: (text: string) =>
+                  render: (text: string, record: LoginHistoryItem) =>
                     text ? (
                       <span className="flex items-center gap-2">{text}</span>
+                    ) : record.grant === "client_credentials" ? (
+                      <Text type="secondary">App (client credentials)</Text>
                     ) : (
                       <Text type="secondary">Unknown</Text>
                     ),
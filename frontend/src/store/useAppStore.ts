@@ -34,6 +34,13 @@ interface AppState {
     logoUrl?: string;
     status: string;
     expiresAt: string;
+    prompt?: string;
+    maxAge?: number | null;
+    loginHint?: string;
+    loginRequired?: boolean;
+    consentRequired?: boolean;
+    deviceIp?: string;
+    deviceUserAgent?: string;
   } | null;
   setSsoDetails: (details: AppState["ssoDetails"]) => void;
   fetchSsoDetails: () => Promise<void>;
@@ -73,6 +80,13 @@ export const useAppStore = create<AppState>((set, get) => ({
   },
 
   logout: () => {
+    const token = get().token;
+    if (token) {
+      // End the session server-side too; the local token is dropped either way
+      api
+        .post("/logout", null, { headers: { Authorization: `Bearer ${token}` } })
+        .catch(() => {});
+    }
     localStorage.removeItem("token");
     set({ token: null, profile: null, myApps: [] });
   },
@@ -78,6 +78,7 @@ export interface TrustedUri {
   id: number;
   name?: string;
   uri: string;
+  kind: "web" | "loopback" | "custom" | "invalid";
   createdAt: string;
 }
 
@@ -100,9 +101,20 @@ export type LoginHistoryItem = {
     user?: string;
     app: string;
     logoUrl?: string;
+    grant?: string;
     time: string;
 }
 
+export type ConnectedApp = {
+    appId: string;
+    app: string;
+    logoUrl?: string;
+    scopes: string[];
+    grantedAt: string;
+    updatedAt: string;
+    lastLogin?: string;
+}
+
 export type AppStats = {
     totalUsers: number;
     history: LoginHistoryItem[];